@@ -20,10 +20,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/holiman/factor/lib"
-	"github.com/naoina/toml"
 	"github.com/urfave/cli/v2"
 )
 
@@ -68,26 +68,87 @@ func relay(c *cli.Context) error {
 	log.SetDefault(log.NewLogger(log.NewTerminalHandlerWithLevel(os.Stderr, log.LevelInfo, true)))
 	//http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	conffile := c.String(configFileFlag.Name)
-	var config lib.Config
-	if data, err := os.ReadFile(conffile); err != nil {
+	config, err := lib.LoadConfig(conffile)
+	if err != nil {
 		log.Error("Error reading config file", "file", conffile, "err", err)
 		return err
-	} else if err := toml.Unmarshal(data, &config); err != nil {
-		log.Error("Error reading config file", "file", config, "err", err)
-		return err
 	}
 	log.Info("Spinning up muxer...")
-	mux, err := lib.NewRelayPI(config.ElClients)
+	mux, err := lib.NewRelayPI(config)
 	if err != nil {
 		return err
 	}
-	log.Info("Spinning up relayer...")
-	fetcher, err := lib.NewFetcher(config.ClClient, mux)
-	fetcher.Start()
+	log.Info("EL capabilities")
+	fmt.Fprint(os.Stderr, mux.CapabilityMatrix())
+
+	var (
+		stop  func()
+		apply = []func(running, next lib.Config) lib.Config{mux.ApplyConfig}
+		cl    lib.CLStatusReporter // nil in passive mode
+	)
+	if config.Passive.Listen != "" {
+		log.Info("Spinning up engine API server...")
+		server, err := lib.NewEngineServer(config.Passive, mux)
+		if err != nil {
+			return err
+		}
+		if err := server.Start(); err != nil {
+			return err
+		}
+		stop = server.Stop
+	} else {
+		log.Info("Spinning up relayer...")
+		fetcher, err := lib.NewFetcher(config, mux)
+		if err != nil {
+			return err
+		}
+		fetcher.Start()
+		stop = fetcher.Stop
+		apply = append(apply, fetcher.ApplyConfig)
+		cl = fetcher
+	}
+	if config.Admin.Listen != "" {
+		admin := lib.NewAdminServer(config.Admin, mux, cl)
+		if err := admin.Start(); err != nil {
+			return err
+		}
+		defer admin.Stop()
+	}
+	if config.Metrics.Listen != "" {
+		metrics := lib.NewMetricsServer(config.Metrics)
+		if err := metrics.Start(); err != nil {
+			return err
+		}
+		defer metrics.Stop()
+	}
 	abortChan := make(chan os.Signal, 1)
 	signal.Notify(abortChan, os.Interrupt)
-	sig := <-abortChan
-	log.Info("Exiting...", "signal", sig)
-	fetcher.Stop()
-	return nil
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	for {
+		select {
+		case <-reloadChan:
+			config = reload(conffile, config, apply)
+		case sig := <-abortChan:
+			log.Info("Exiting...", "signal", sig)
+			stop()
+			mux.Close()
+			return nil
+		}
+	}
+}
+
+// reload re-reads the config file, and applies the changes to the running
+// components. If the new config is invalid, the running one is kept.
+func reload(conffile string, running lib.Config, apply []func(running, next lib.Config) lib.Config) lib.Config {
+	log.Info("Reloading config file", "file", conffile)
+	next, err := lib.LoadConfig(conffile)
+	if err != nil {
+		log.Error("Invalid config file, keeping the running config", "file", conffile, "err", err)
+		return running
+	}
+	for _, fn := range apply {
+		running = fn(running, next)
+	}
+	return running
 }
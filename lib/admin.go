@@ -0,0 +1,249 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// blockRef identifies a block in status reports.
+type blockRef struct {
+	Number uint64      `json:"number"`
+	Hash   common.Hash `json:"hash"`
+}
+
+// clStatus is the status of the CL side of the relay.
+type clStatus struct {
+	Source    string    `json:"source"`              // CL source in use
+	Streaming bool      `json:"streaming"`           // whether the event stream is connected
+	Head      *blockRef `json:"head,omitempty"`      // last fetched head
+	Finalized *blockRef `json:"finalized,omitempty"` // last fetched finalized block
+}
+
+// CLStatusReporter reports the status of the CL side of the relay. It is
+// implemented by the fetcher.
+type CLStatusReporter interface {
+	CLStatus() clStatus
+}
+
+// CLStatus returns the CL source in use, and the last blocks fetched from it.
+func (f *fetcher) CLStatus() clStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return clStatus{
+		Source:    f.cls[f.active].name,
+		Streaming: f.streaming.Load(),
+		Head:      f.lastHead,
+		Finalized: f.lastFinal,
+	}
+}
+
+// elStatus is the status of one EL.
+type elStatus struct {
+	Name         string                  `json:"name"`
+	Client       *engine.ClientVersionV1 `json:"client,omitempty"`
+	Primary      bool                    `json:"primary"`
+	Builder      bool                    `json:"builder"`
+	Breaker      string                  `json:"breaker,omitempty"`      // circuit breaker state
+	BreakerUntil *time.Time              `json:"breakerUntil,omitempty"` // time the open breaker lets probes through
+	Paused       bool                    `json:"paused"`
+	PausedUntil  *time.Time              `json:"pausedUntil,omitempty"` // end of the pause, if not until resumed
+	Pending      int                     `json:"pending"`               // queued calls
+	Dropped      uint64                  `json:"dropped"`               // calls dropped from the queue
+	elStats
+}
+
+// Status returns the status of all ELs, in order of preference.
+func (r *relayPI) Status() []elStatus {
+	r.mu.Lock()
+	var (
+		els, workers = r.els, r.workers
+		primary      = r.els[r.primary]
+		builder      = r.builder
+	)
+	r.mu.Unlock()
+
+	status := make([]elStatus, len(els))
+	for i, el := range els {
+		status[i] = workerStatus(workers[i])
+		status[i].Primary = el == primary
+		status[i].Builder = el == builder || (builder == nil && el == primary)
+	}
+	return status
+}
+
+func workerStatus(w *elWorker) elStatus {
+	status := elStatus{
+		Name:    w.el.Name(),
+		Client:  clientVersion(w.el),
+		Pending: w.Pending(),
+		Dropped: w.dropped.Load(),
+		elStats: w.Stats(),
+	}
+	if el, ok := w.el.(*remoteEL); ok {
+		status.Breaker = el.breaker.State().String()
+		if until := el.breaker.openUntil(); !until.IsZero() {
+			status.BreakerUntil = &until
+		}
+	}
+	paused, until := w.pauseState()
+	status.Paused = paused
+	if paused && !until.IsZero() {
+		status.PausedUntil = &until
+	}
+	return status
+}
+
+// worker returns the worker of the EL with the given name.
+func (r *relayPI) worker(name string) (*elWorker, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.indexOf(name)
+	if i < 0 {
+		return nil, fmt.Errorf("unknown EL %q", name)
+	}
+	return r.workers[i], nil
+}
+
+// PauseEL stops the delivery to the EL for the given duration, or until it is
+// resumed if zero. A paused EL is not used as primary.
+func (r *relayPI) PauseEL(name string, d time.Duration) error {
+	w, err := r.worker(name)
+	if err != nil {
+		return err
+	}
+	w.pause(d)
+	log.Warn("Paused EL", "el", elIdentity(w.el), "duration", d)
+	return nil
+}
+
+// ResumeEL resumes the delivery to a paused EL.
+func (r *relayPI) ResumeEL(name string) error {
+	w, err := r.worker(name)
+	if err != nil {
+		return err
+	}
+	w.resume()
+	log.Info("Resumed EL", "el", elIdentity(w.el))
+	return nil
+}
+
+// ResendEL delivers the latest head payload and forkchoice update to the EL
+// again, replaying missing ancestors if needed.
+func (r *relayPI) ResendEL(name string) error {
+	w, err := r.worker(name)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.bootstrap(w)
+	r.mu.Unlock()
+	log.Info("Resending head to EL", "el", elIdentity(w.el))
+	return nil
+}
+
+// adminStatus is the response of the status endpoint.
+type adminStatus struct {
+	CL  *clStatus  `json:"cl,omitempty"` // not set in passive mode
+	ELs []elStatus `json:"els"`
+}
+
+// adminServer serves the admin HTTP API.
+type adminServer struct {
+	*httpServer
+	relay *relayPI
+	cl    CLStatusReporter // nil in passive mode
+}
+
+// NewAdminServer creates the admin API server. The CL status reporter may be
+// nil in passive mode.
+func NewAdminServer(config AdminConfig, relay *relayPI, cl CLStatusReporter) *adminServer {
+	s := &adminServer{relay: relay, cl: cl}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /capabilities", s.handleCapabilities)
+	mux.HandleFunc("POST /els/{name}/pause", s.handlePause)
+	mux.HandleFunc("POST /els/{name}/resume", s.handleResume)
+	mux.HandleFunc("POST /els/{name}/resend", s.handleResend)
+	s.httpServer = newHTTPServer("admin", config.Listen, mux)
+	return s
+}
+
+func (s *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := adminStatus{ELs: s.relay.Status()}
+	if s.cl != nil {
+		cl := s.cl.CLStatus()
+		status.CL = &cl
+	}
+	writeJSON(w, status)
+}
+
+func (s *adminServer) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(s.relay.CapabilityMatrix()))
+}
+
+func (s *adminServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	var d time.Duration
+	if param := r.URL.Query().Get("duration"); param != "" {
+		var err error
+		if d, err = time.ParseDuration(param); err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", param), http.StatusBadRequest)
+			return
+		}
+	}
+	s.respondEL(w, r, s.relay.PauseEL(r.PathValue("name"), d))
+}
+
+func (s *adminServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	s.respondEL(w, r, s.relay.ResumeEL(r.PathValue("name")))
+}
+
+func (s *adminServer) handleResend(w http.ResponseWriter, r *http.Request) {
+	s.respondEL(w, r, s.relay.ResendEL(r.PathValue("name")))
+}
+
+// respondEL responds to a request on an EL with its status, or the error.
+func (s *adminServer) respondEL(w http.ResponseWriter, r *http.Request, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	for _, status := range s.relay.Status() {
+		if status.Name == r.PathValue("name") {
+			writeJSON(w, status)
+			return
+		}
+	}
+	http.Error(w, "EL removed", http.StatusNotFound)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debug("Failed to write admin response", "err", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type staticCL clStatus
+
+func (s staticCL) CLStatus() clStatus { return clStatus(s) }
+
+func TestAdminAPI(t *testing.T) {
+	var (
+		a, b  = newMockEL("a"), newMockEL("b")
+		relay = newRelay([]ElApi{a, b})
+		head  = &blockRef{Number: 7, Hash: common.Hash{7}}
+		admin = NewAdminServer(AdminConfig{}, relay, staticCL{Source: "prysm", Head: head})
+	)
+	defer relay.Close()
+	request := func(method, path string, wantCode int, result interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		admin.http.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		if rec.Code != wantCode {
+			t.Fatalf("%s %s: have code %d, want %d: %s", method, path, rec.Code, wantCode, rec.Body)
+		}
+		if result != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	deliver := func(number byte) {
+		payload := engine.ExecutableData{Number: uint64(number), BlockHash: common.Hash{number}}
+		relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+		relay.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{HeadBlockHash: payload.BlockHash}, nil)
+	}
+	deliver(7)
+	b.waitCalls(t, 2)
+
+	var status adminStatus
+	request("GET", "/status", http.StatusOK, &status)
+	if status.CL == nil || status.CL.Source != "prysm" || *status.CL.Head != *head {
+		t.Fatalf("wrong CL status: %+v", status.CL)
+	}
+	if len(status.ELs) != 2 || !status.ELs[0].Primary || status.ELs[1].Primary {
+		t.Fatalf("wrong EL status: %+v", status.ELs)
+	}
+	if el := status.ELs[1]; el.LastBlock == nil || el.LastBlock.Number != 7 || el.LastStatus != engine.VALID || el.Paused {
+		t.Fatalf("wrong EL status: %+v", el)
+	}
+
+	// A paused EL gets no calls, and is not used as primary.
+	var el elStatus
+	request("POST", "/els/a/pause", http.StatusOK, &el)
+	if !el.Paused || el.PausedUntil != nil {
+		t.Fatalf("wrong paused status: %+v", el)
+	}
+	request("POST", "/els/b/pause?duration=1h", http.StatusOK, &el)
+	if !el.Paused || el.PausedUntil == nil {
+		t.Fatalf("wrong paused status: %+v", el)
+	}
+	request("POST", "/els/b/resume", http.StatusOK, &el)
+	deliver(8)
+	b.waitCalls(t, 4)
+	if have := relay.Primary(); have != "b" {
+		t.Fatalf("have primary %s, want b", have)
+	}
+	// Wait for the calls to a to be failed, before resuming it.
+	for deadline := time.Now().Add(time.Second); relay.tracker.Pending() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("calls still pending")
+		}
+	}
+	a.waitCalls(t, 2)
+	request("POST", "/els/a/resume", http.StatusOK, nil)
+
+	// A resend delivers the latest head again.
+	request("POST", "/els/a/resend", http.StatusOK, nil)
+	a.waitCalls(t, 4)
+	if have := a.methods[2]; have != "NP 8" {
+		t.Fatalf("have resent call %s, want NP 8", have)
+	}
+
+	request("POST", "/els/x/pause", http.StatusNotFound, nil)
+	request("POST", "/els/a/pause?duration=soon", http.StatusBadRequest, nil)
+	request("GET", "/els/a/pause", http.StatusMethodNotAllowed, nil)
+}
@@ -21,16 +21,62 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// engineMethods are the engine API methods used by Factor, both when calling the
+// ELs and when serving the CL in passive mode.
+var engineMethods = []string{
+	"engine_forkchoiceUpdatedV1",
+	"engine_forkchoiceUpdatedV2",
+	"engine_forkchoiceUpdatedV3",
+	"engine_newPayloadV1",
+	"engine_newPayloadV2",
+	"engine_newPayloadV3",
+	"engine_newPayloadV4",
+	"engine_getPayloadV1",
+	"engine_getPayloadV2",
+	"engine_getPayloadV3",
+	"engine_getPayloadV4",
+	"engine_exchangeTransitionConfigurationV1",
+	"engine_getClientVersionV1",
+}
+
 type ElApi interface {
-	// ForkchoiceUpdatedV1 informs the EL about the most recent head.
-	ForkchoiceUpdatedV1(update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error)
+	// ForkchoiceUpdated informs the EL about the most recent head, using
+	// engine_forkchoiceUpdatedV<version>.
+	ForkchoiceUpdated(version engine.PayloadVersion, update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error)
 	// ExchangeTransitionConfigurationV1 checks the given configuration against the configuration of the node.
 	ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error)
-	// GetPayloadV1 returns a cached payload by id.
-	GetPayloadV1(payloadID engine.PayloadID) (*engine.ExecutableData, error)
-	// NewPayloadV3 creates an Eth1 block, inserts it in the chain, and returns the status of the chain.
-	NewPayloadV3(params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash) (engine.PayloadStatusV1, error)
+	// GetPayload returns a payload built by the EL, by the id returned from
+	// ForkchoiceUpdated, using engine_getPayloadV<version>.
+	GetPayload(version engine.PayloadVersion, payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error)
+	// NewPayload creates an Eth1 block, inserts it in the chain, and returns the status of the chain,
+	// using engine_newPayloadV<version>. The versioned hashes and beacon root are only sent from V3,
+	// the execution requests from V4.
+	NewPayload(version engine.PayloadVersion, params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash, executionRequests [][]byte) (engine.PayloadStatusV1, error)
 
 	// Name for the EL, as per configuration.
 	Name() string
 }
+
+// healthReporter is implemented by ELs which can tell whether they are
+// currently usable. ELs which don't are assumed to be healthy.
+type healthReporter interface {
+	Healthy() bool
+}
+
+// capabilityReporter is implemented by ELs which know the engine API methods
+// they support. A nil result means they are not known yet.
+type capabilityReporter interface {
+	Capabilities() map[string]bool
+}
+
+// versionReporter is implemented by ELs which know their client version. A nil
+// result means it is not known yet.
+type versionReporter interface {
+	ClientVersion() *engine.ClientVersionV1
+}
+
+// isHealthy reports whether the EL is usable.
+func isHealthy(el ElApi) bool {
+	h, ok := el.(healthReporter)
+	return !ok || h.Healthy()
+}
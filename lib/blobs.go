@@ -0,0 +1,95 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+)
+
+// archivedBlob is the format of the blob archive files.
+type archivedBlob struct {
+	Blob       *kzg4844.Blob      `json:"blob"`
+	Commitment kzg4844.Commitment `json:"commitment"`
+	Proof      kzg4844.Proof      `json:"proof"`
+}
+
+// blobArchive stores verified blobs in a directory, one file per blob, named
+// by its versioned hash.
+type blobArchive struct {
+	dir string
+}
+
+func newBlobArchive(dir string) (*blobArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &blobArchive{dir: dir}, nil
+}
+
+func (a *blobArchive) path(versionedHash common.Hash) string {
+	return filepath.Join(a.dir, versionedHash.Hex()+".json")
+}
+
+// Store verifies the sidecars of a block against its versioned hashes, and
+// writes them to the archive. Sidecars are only written if all of them verify.
+func (a *blobArchive) Store(sidecars []blobSidecar, versionedHashes []common.Hash) error {
+	if len(sidecars) != len(versionedHashes) {
+		return fmt.Errorf("%d sidecars, %d blob hashes", len(sidecars), len(versionedHashes))
+	}
+	hasher := sha256.New()
+	for i, sc := range sidecars {
+		if int(sc.Index) != i || sc.Blob == nil {
+			return fmt.Errorf("sidecar %d: unexpected index %d or missing blob", i, sc.Index)
+		}
+		if have := common.Hash(kzg4844.CalcBlobHashV1(hasher, &sc.KzgCommitment)); have != versionedHashes[i] {
+			return fmt.Errorf("sidecar %d: commitment hash %v, want %v", i, have, versionedHashes[i])
+		}
+		if err := kzg4844.VerifyBlobProof(sc.Blob, sc.KzgCommitment, sc.KzgProof); err != nil {
+			return fmt.Errorf("sidecar %d: %v", i, err)
+		}
+	}
+	for i, sc := range sidecars {
+		enc, err := json.Marshal(archivedBlob{Blob: sc.Blob, Commitment: sc.KzgCommitment, Proof: sc.KzgProof})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(a.path(versionedHashes[i]), enc, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads the blob with the given versioned hash from the archive.
+func (a *blobArchive) Load(versionedHash common.Hash) (*archivedBlob, error) {
+	enc, err := os.ReadFile(a.path(versionedHash))
+	if err != nil {
+		return nil, err
+	}
+	blob := new(archivedBlob)
+	if err := json.Unmarshal(enc, blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+)
+
+func TestBlobArchive(t *testing.T) {
+	var (
+		blob   = new(kzg4844.Blob)
+		hashes []common.Hash
+	)
+	for i := 0; i < len(blob); i += 32 {
+		blob[i+31] = byte(i / 32) // keep field elements canonical
+	}
+	commitment, err := kzg4844.BlobToCommitment(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := kzg4844.ComputeBlobProof(blob, commitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes = append(hashes, kzg4844.CalcBlobHashV1(sha256.New(), &commitment))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eth/v1/beacon/blob_sidecars/42" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []map[string]interface{}{{
+				"index":          "0",
+				"blob":           blob,
+				"kzg_commitment": commitment,
+				"kzg_proof":      proof,
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	cl, _ := newRemoteCL(srv.URL, "test", nil)
+	sidecars, err := cl.GetBlobSidecars("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := newBlobArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sidecars which don't belong to the block are refused.
+	if err := archive.Store(sidecars, []common.Hash{{1}}); err == nil {
+		t.Fatal("stored sidecar with wrong versioned hash")
+	}
+	bad := sidecars[0]
+	bad.KzgProof[0] ^= 1
+	if err := archive.Store([]blobSidecar{bad}, hashes); err == nil {
+		t.Fatal("stored sidecar with invalid proof")
+	}
+	if _, err := archive.Load(hashes[0]); err == nil {
+		t.Fatal("invalid sidecar was archived")
+	}
+	if err := archive.Store(sidecars, hashes); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := archive.Load(hashes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stored.Blob != *blob || stored.Commitment != commitment || stored.Proof != proof {
+		t.Fatal("archived blob mismatch")
+	}
+}
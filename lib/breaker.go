@@ -0,0 +1,209 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	defaultBreakerThreshold = 6               // consecutive failures which open the breaker
+	defaultBreakerCooldown  = 2 * time.Minute // time the breaker stays open before probing
+	defaultBreakerProbes    = 1               // successful probes which close the breaker
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // calls go through
+	breakerOpen                         // calls are refused
+	breakerHalfOpen                     // probe calls go through, one at a time
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breakerEvent is emitted when the circuit breaker of an EL changes state.
+type breakerEvent struct {
+	EL       string
+	From, To breakerState
+}
+
+// breaker is a circuit breaker for the calls to an EL. It opens after a number
+// of consecutive failures, and refuses calls for a cooldown period. After that
+// it lets probe calls through one at a time, and closes again once enough of
+// them succeed.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	probes    int
+	feed      *event.Feed      // receives state changes, may be nil
+	now       func() time.Time // replaced in tests
+	identity  func() string    // describes the EL in logs
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int            // consecutive failures while closed
+	successes int            // successful probes while half-open
+	probing   bool           // whether a probe is in flight
+	openedAt  time.Time      // time the breaker last opened
+	events    []breakerEvent // state changes to emit once the lock is released
+}
+
+// newBreaker creates a breaker with the thresholds of the EL configuration.
+func newBreaker(conf ELConfig, feed *event.Feed) *breaker {
+	b := &breaker{
+		name:      conf.Name,
+		threshold: defaultBreakerThreshold,
+		cooldown:  defaultBreakerCooldown,
+		probes:    defaultBreakerProbes,
+		feed:      feed,
+		now:       time.Now,
+		identity:  func() string { return conf.Name },
+	}
+	if conf.BreakerThreshold > 0 {
+		b.threshold = conf.BreakerThreshold
+	}
+	if conf.BreakerCooldown > 0 {
+		b.cooldown = time.Duration(conf.BreakerCooldown) * time.Second
+	}
+	if conf.BreakerProbes > 0 {
+		b.probes = conf.BreakerProbes
+	}
+	return b
+}
+
+// State returns the current state of the breaker.
+func (b *breaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// openUntil returns the time the open breaker lets probe calls through again,
+// or zero if it is not open.
+func (b *breaker) openUntil() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return time.Time{}
+	}
+	return b.openedAt.Add(b.cooldown)
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be
+// followed by a call to done.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.successes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return errBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of an allowed call.
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.unlock()
+
+	switch b.state {
+	case breakerClosed:
+		if err == nil {
+			b.failures = 0
+			return
+		}
+		if b.failures++; b.failures >= b.threshold {
+			b.open()
+		}
+	case breakerHalfOpen:
+		b.probing = false
+		if err != nil {
+			b.open()
+			return
+		}
+		if b.successes++; b.successes >= b.probes {
+			b.failures = 0
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+// open opens the breaker. The lock must be held.
+func (b *breaker) open() {
+	b.openedAt = b.now()
+	b.setState(breakerOpen)
+}
+
+// setState changes the state, and emits the change. The lock must be held.
+func (b *breaker) setState(state breakerState) {
+	if state == b.state {
+		return
+	}
+	ev := breakerEvent{EL: b.name, From: b.state, To: state}
+	b.state = state
+	switch state {
+	case breakerOpen:
+		log.Warn("EL circuit breaker opened", "el", b.identity(), "from", ev.From, "cooldown", b.cooldown)
+	default:
+		log.Info("EL circuit breaker state changed", "el", b.identity(), "from", ev.From, "to", state)
+	}
+	b.events = append(b.events, ev)
+}
+
+// unlock releases the lock, and emits the state changes made while it was
+// held.
+func (b *breaker) unlock() {
+	events := b.events
+	b.events = nil
+	b.mu.Unlock()
+	if b.feed != nil {
+		for _, ev := range events {
+			b.feed.Send(ev)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+func TestBreaker(t *testing.T) {
+	var (
+		feed   = new(event.Feed)
+		events = make(chan breakerEvent, 10)
+		clock  = time.Unix(0, 0)
+		b      = newBreaker(ELConfig{Name: "el", BreakerThreshold: 2, BreakerCooldown: 10, BreakerProbes: 2}, feed)
+		fail   = errors.New("fail")
+	)
+	sub := feed.Subscribe(events)
+	defer sub.Unsubscribe()
+	b.now = func() time.Time { return clock }
+
+	expect := func(from, to breakerState) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.EL != "el" || ev.From != from || ev.To != to {
+				t.Fatalf("have event %v, want %v -> %v", ev, from, to)
+			}
+		default:
+			t.Fatalf("missing event %v -> %v", from, to)
+		}
+	}
+	call := func(err error) error {
+		t.Helper()
+		if err := b.allow(); err != nil {
+			return err
+		}
+		b.done(err)
+		return nil
+	}
+	// Failures must be consecutive to open the breaker.
+	call(fail)
+	call(nil)
+	call(fail)
+	if b.State() != breakerClosed {
+		t.Fatal("breaker opened on non-consecutive failures")
+	}
+	if !b.openUntil().IsZero() {
+		t.Fatal("closed breaker reports cooldown")
+	}
+	call(fail)
+	expect(breakerClosed, breakerOpen)
+	if have, want := b.openUntil(), clock.Add(10*time.Second); !have.Equal(want) {
+		t.Fatalf("have open until %v, want %v", have, want)
+	}
+	if err := call(nil); err != errBreakerOpen {
+		t.Fatalf("have %v, want %v", err, errBreakerOpen)
+	}
+	// After the cooldown, one probe at a time goes through.
+	clock = clock.Add(10 * time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	expect(breakerOpen, breakerHalfOpen)
+	if err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("concurrent probe: have %v, want %v", err, errBreakerOpen)
+	}
+	// A failed probe opens it again.
+	b.done(fail)
+	expect(breakerHalfOpen, breakerOpen)
+	clock = clock.Add(10 * time.Second)
+	call(nil)
+	expect(breakerOpen, breakerHalfOpen)
+	call(nil)
+	expect(breakerHalfOpen, breakerClosed)
+}
+
+func TestRemoteELBreaker(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-38002,"message":"Invalid forkchoice state"}}`))
+	}))
+	defer srv.Close()
+
+	el, err := newRemoteEL(ELConfig{Name: "el", Address: srv.URL, BreakerThreshold: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close()
+	// Error responses don't count as failures.
+	for i := 0; i < 3; i++ {
+		if _, err := el.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{}, nil); err == nil {
+			t.Fatal("expected error response")
+		}
+	}
+	if !el.Healthy() {
+		t.Fatal("breaker opened on error responses")
+	}
+	// Every call counts towards the threshold, whatever the method.
+	down.Store(true)
+	el.NewPayload(engine.PayloadV3, engine.ExecutableData{}, nil, nil, nil)
+	el.ExchangeTransitionConfigurationV1(engine.TransitionConfigurationV1{})
+	if el.Healthy() {
+		t.Fatal("breaker not opened")
+	}
+	if _, err := el.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{}, nil); err != errBreakerOpen {
+		t.Fatalf("have %v, want %v", err, errBreakerOpen)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// capabilityRefresh is how often the capabilities of an EL are exchanged
+// again, to notice upgrades.
+const capabilityRefresh = 5 * time.Minute
+
+// errUnsupported is returned without calling the EL if it lacks every version
+// of a method which the call could be made with. It is not a failure of the EL,
+// and is not compared against the answers of the others.
+var errUnsupported = errors.New("method not supported by EL")
+
+// exchangeCapabilities fetches the engine API methods supported by the EL,
+// via engine_exchangeCapabilities.
+func (r *remoteEL) exchangeCapabilities() error {
+	var methods []string
+	if err := r.query(&methods, "engine_exchangeCapabilities", engineMethods); err != nil {
+		return err
+	}
+	caps := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		caps[m] = true
+	}
+	r.mu.Lock()
+	old := r.caps
+	r.caps = caps
+	r.mu.Unlock()
+	if old != nil && !maps.Equal(old, caps) {
+		log.Info("EL capabilities changed", "el", r.Identity(), "methods", len(methods))
+	}
+	return nil
+}
+
+// Capabilities returns the engine API methods supported by the EL, or nil if
+// they are not known.
+func (r *remoteEL) Capabilities() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.caps)
+}
+
+// refresh queries the client version and capabilities of the EL.
+func (r *remoteEL) refresh() {
+	if err := r.identify(); err != nil && r.ctx.Err() == nil {
+		log.Info("Client version query failed", "el", r.Identity(), "err", err)
+	}
+	if err := r.exchangeCapabilities(); err != nil && r.ctx.Err() == nil {
+		log.Info("Capability exchange failed, assuming all methods are supported", "el", r.Identity(), "err", err)
+	}
+}
+
+// refreshLoop queries the client version and capabilities at startup, then
+// periodically and whenever the EL recovers from an outage, off the path of
+// the relayed calls.
+func (r *remoteEL) refreshLoop() {
+	defer r.wg.Done()
+
+	r.refresh()
+	ticker := time.NewTicker(capabilityRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh()
+		case <-r.refreshCh:
+			r.refresh()
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// methodVersion returns the newest version of the method, from the given
+// minimum up to the given version, which the EL supports. If its capabilities
+// are not known, the given version is used. The minimum is the version the fork
+// of the call requires, older versions would drop or misread its fields.
+func (r *remoteEL) methodVersion(method string, version, min engine.PayloadVersion) (engine.PayloadVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.caps == nil {
+		return version, nil
+	}
+	for v := version; v >= min; v-- {
+		if r.caps[fmt.Sprintf("%s%d", method, v)] {
+			if v != version {
+				log.Debug("EL lacks method version, downgrading", "el", identity(r.name, r.version), "method", method, "want", version, "have", v)
+			}
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s%d", errUnsupported, method, min)
+}
+
+// payloadFork returns the oldest fork whose payloads carry the given fields.
+func payloadFork(params engine.ExecutableData, beaconRoot *common.Hash, requests [][]byte) fork {
+	switch {
+	case requests != nil:
+		return forkElectra
+	case beaconRoot != nil || params.BlobGasUsed != nil:
+		return forkDeneb
+	case params.Withdrawals != nil:
+		return forkCapella
+	default:
+		return forkBellatrix
+	}
+}
+
+// attributesFork returns the oldest fork whose payload attributes carry the
+// given fields.
+func attributesFork(attrs *engine.PayloadAttributes) fork {
+	switch {
+	case attrs == nil:
+		return forkBellatrix
+	case attrs.BeaconRoot != nil:
+		return forkDeneb
+	case attrs.Withdrawals != nil:
+		return forkCapella
+	default:
+		return forkBellatrix
+	}
+}
+
+// CapabilityMatrix returns a table of the engine API methods supported by each
+// EL: "yes" if supported, "-" if not, and "?" if not known. It is printed at
+// startup, and served at runtime by the admin API.
+func (r *relayPI) CapabilityMatrix() string {
+	var (
+		buf    bytes.Buffer
+		w      = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		els, _ = r.snapshot()
+	)
+	fmt.Fprint(w, "METHOD")
+	for _, el := range els {
+		fmt.Fprintf(w, "\t%s", el.Name())
+	}
+	fmt.Fprintln(w)
+	for _, method := range engineMethods {
+		fmt.Fprint(w, method)
+		for _, el := range els {
+			cell := "?"
+			if c, ok := el.(capabilityReporter); ok {
+				if caps := c.Capabilities(); caps != nil {
+					cell = "-"
+					if caps[method] {
+						cell = "yes"
+					}
+				}
+			}
+			fmt.Fprintf(w, "\t%s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCapabilities(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		called []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		called = append(called, req.Method)
+		mu.Unlock()
+		var result interface{} = map[string]interface{}{"status": engine.VALID}
+		switch req.Method {
+		case "engine_getClientVersionV1":
+			result = []engine.ClientVersionV1{{Code: "GE", Name: "go-ethereum", Version: "1.15.11", Commit: "0x36b2371c"}}
+		case "engine_exchangeCapabilities":
+			// A client lagging behind on newPayloadV4.
+			result = []string{"engine_newPayloadV2", "engine_newPayloadV3", "engine_forkchoiceUpdatedV3"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	defer srv.Close()
+
+	el, err := newRemoteEL(ELConfig{Name: "lagging", Address: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The capabilities are exchanged in the background.
+	waitFor(t, "capabilities", func() bool { return el.Capabilities() != nil })
+	if caps := el.Capabilities(); len(caps) != 3 || !caps["engine_newPayloadV3"] {
+		t.Fatalf("wrong capabilities: %v", caps)
+	}
+	// The newest supported version is used, up to the requested one.
+	el.NewPayload(payloadV4, engine.ExecutableData{}, nil, nil, nil)
+	el.NewPayload(engine.PayloadV2, engine.ExecutableData{}, nil, nil, nil)
+	if _, err := el.NewPayload(engine.PayloadV1, engine.ExecutableData{}, nil, nil, nil); !errors.Is(err, errUnsupported) {
+		t.Fatalf("have %v, want %v", err, errUnsupported)
+	}
+	// An electra payload is never sent with an older version, which would
+	// drop its execution requests.
+	beaconRoot := common.Hash{1}
+	if _, err := el.NewPayload(payloadV4, engine.ExecutableData{}, nil, &beaconRoot, [][]byte{}); !errors.Is(err, errUnsupported) {
+		t.Fatalf("have %v, want %v", err, errUnsupported)
+	}
+	el.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{}, nil)
+	if !el.Healthy() {
+		t.Fatal("unsupported calls counted as failures")
+	}
+	mu.Lock()
+	have := strings.Join(called, ",")
+	mu.Unlock()
+	if want := "engine_getClientVersionV1,engine_exchangeCapabilities,engine_newPayloadV3,engine_newPayloadV2,engine_forkchoiceUpdatedV3"; have != want {
+		t.Fatalf("have calls %s, want %s", have, want)
+	}
+
+	relay := newRelay([]ElApi{el, newMockEL("mock")})
+	defer relay.Close()
+	matrix := relay.CapabilityMatrix()
+	for _, want := range []string{
+		"engine_newPayloadV3                       yes      ?",
+		"engine_newPayloadV4                       -        ?",
+	} {
+		if !strings.Contains(matrix, want) {
+			t.Errorf("matrix missing %q:\n%s", want, matrix)
+		}
+	}
+}
+
+// waitFor waits until the condition holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestRemoteELRefreshNonBlocking(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	// Neither creating the EL nor closing it waits for the unresponsive
+	// client.
+	start := time.Now()
+	el, err := newRemoteEL(ELConfig{Name: "hanging", Address: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %v", elapsed)
+	}
+	if !el.Healthy() {
+		t.Fatal("refresh counted as failure")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// payloadCacheSize is the number of recently relayed payloads kept, to replay
+// them to ELs which missed them.
+const payloadCacheSize = 64
+
+var errCatchUpFailed = errors.New("catch-up failed")
+
+// payloadCall holds the parameters of a relayed newPayload call.
+type payloadCall struct {
+	version         engine.PayloadVersion
+	params          engine.ExecutableData
+	versionedHashes []common.Hash
+	beaconRoot      *common.Hash
+	requests        [][]byte
+}
+
+func (c *payloadCall) send(el ElApi) (engine.PayloadStatusV1, error) {
+	return el.NewPayload(c.version, c.params, c.versionedHashes, c.beaconRoot, c.requests)
+}
+
+// sendPayload delivers the payload to the EL, and schedules a catch-up if the
+// EL could not validate it.
+func (r *relayPI) sendPayload(el ElApi, call *payloadCall) (engine.PayloadStatusV1, error) {
+	status, err := call.send(el)
+	if needsCatchUp(status, err) {
+		r.scheduleCatchUp(el, call)
+	}
+	return status, err
+}
+
+// forkchoiceCall holds the parameters of a relayed forkchoiceUpdated call.
+type forkchoiceCall struct {
+	version engine.PayloadVersion
+	state   engine.ForkchoiceStateV1
+}
+
+// needsCatchUp reports whether the EL could not validate a payload, because
+// it is missing the parent.
+func needsCatchUp(status engine.PayloadStatusV1, err error) bool {
+	return err == nil && (status.Status == engine.SYNCING || status.Status == engine.ACCEPTED)
+}
+
+// scheduleCatchUp queues a catch-up of the given EL to the payload. If one is
+// already queued, it is retargeted to the payload instead, since the EL could
+// not validate that one either.
+func (r *relayPI) scheduleCatchUp(el ElApi, head *payloadCall) {
+	worker := r.workerOf(el)
+	if worker == nil {
+		return
+	}
+	worker.catchUpTo.Store(head)
+	if !worker.catchingUp.CompareAndSwap(false, true) {
+		return
+	}
+	worker.push(&elTask{
+		method: "catchup",
+		call: func(el ElApi) (engine.PayloadStatusV1, error) {
+			return r.catchUp(el, worker.catchUpTo.Load())
+		},
+		record: func(elAnswer) { worker.catchingUp.Store(false) },
+	})
+}
+
+// catchUp replays cached ancestors of a payload to an EL which could not
+// validate it. It walks back from the parent until the EL reports an ancestor
+// as valid, then delivers the descendants in order, the payload itself, and
+// finally the latest forkchoice update.
+func (r *relayPI) catchUp(el ElApi, head *payloadCall) (engine.PayloadStatusV1, error) {
+	var (
+		branch = []*payloadCall{head}
+		parent = head.params.ParentHash
+	)
+	for {
+		r.mu.Lock()
+		call, ok := r.payloads.Peek(parent)
+		r.mu.Unlock()
+		if !ok || len(branch) > payloadCacheSize {
+			log.Info("EL too far behind to catch up", "el", elIdentity(el), "number", head.params.Number, "missing", parent)
+			return engine.PayloadStatusV1{}, errCatchUpFailed
+		}
+		status, err := call.send(el)
+		if err != nil {
+			return status, err
+		}
+		if status.Status == engine.INVALID {
+			log.Warn("EL rejected ancestor during catch-up", "el", elIdentity(el), "number", call.params.Number, "hash", call.params.BlockHash)
+			return status, errCatchUpFailed
+		}
+		if status.Status == engine.VALID {
+			break
+		}
+		branch = append(branch, call)
+		parent = call.params.ParentHash
+	}
+	log.Info("Catching up EL", "el", elIdentity(el), "blocks", len(branch), "head", head.params.Number)
+	var (
+		status engine.PayloadStatusV1
+		err    error
+	)
+	for i := len(branch) - 1; i >= 0; i-- {
+		if status, err = branch[i].send(el); err != nil || status.Status != engine.VALID {
+			log.Warn("EL catch-up stalled", "el", elIdentity(el), "number", branch[i].params.Number, "status", status.Status, "err", err)
+			return status, errCatchUpFailed
+		}
+	}
+	r.mu.Lock()
+	fcu := r.lastForkchoice
+	r.mu.Unlock()
+	if fcu != nil {
+		if _, err := el.ForkchoiceUpdated(fcu.version, fcu.state, nil); err != nil {
+			log.Info("Remote call error", "method", "catchup FCU", "el", elIdentity(el), "err", err)
+		}
+	}
+	return status, nil
+}
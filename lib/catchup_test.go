@@ -0,0 +1,187 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// syncEL is an EL which only validates payloads whose parent it knows, and
+// answers SYNCING otherwise.
+type syncEL struct {
+	*mockEL
+	offline bool
+	hold    uint64 // number of a payload which waits for the gate, if set
+	known   map[common.Hash]bool
+	head    common.Hash
+}
+
+func (s *syncEL) NewPayload(version engine.PayloadVersion, params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash, executionRequests [][]byte) (engine.PayloadStatusV1, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.offline {
+		return engine.PayloadStatusV1{}, errors.New("offline")
+	}
+	if s.hold != 0 && params.Number == s.hold {
+		s.mu.Unlock()
+		s.wait()
+		s.mu.Lock()
+	}
+	if !s.known[params.ParentHash] {
+		return engine.PayloadStatusV1{Status: engine.SYNCING}, nil
+	}
+	s.known[params.BlockHash] = true
+	return engine.PayloadStatusV1{Status: engine.VALID, LatestValidHash: &params.BlockHash}, nil
+}
+
+func (s *syncEL) ForkchoiceUpdated(version engine.PayloadVersion, update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.known[update.HeadBlockHash] {
+		return engine.ForkChoiceResponse{PayloadStatus: engine.PayloadStatusV1{Status: engine.SYNCING}}, nil
+	}
+	s.head = update.HeadBlockHash
+	return engine.ForkChoiceResponse{PayloadStatus: engine.PayloadStatusV1{Status: engine.VALID}}, nil
+}
+
+func (s *syncEL) setOffline(offline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offline = offline
+}
+
+func TestRelayCatchUp(t *testing.T) {
+	var (
+		primary = newMockEL("primary")
+		lagging = &syncEL{mockEL: newMockEL("lagging"), known: map[common.Hash]bool{{}: true}}
+		relay   = newRelay([]ElApi{primary, lagging})
+		parent  common.Hash
+	)
+	defer relay.Close()
+
+	deliver := func(number uint64) {
+		payload := engine.ExecutableData{Number: number, ParentHash: parent, BlockHash: common.Hash{byte(number)}}
+		relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+		relay.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{HeadBlockHash: payload.BlockHash}, nil)
+		parent = payload.BlockHash
+	}
+	deliver(1)
+	lagging.setOffline(true)
+	for n := uint64(2); n <= 5; n++ {
+		deliver(n)
+	}
+	lagging.setOffline(false)
+	deliver(6)
+
+	// The lagging EL gets blocks 2-5 replayed, then block 6 and its head.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		lagging.mu.Lock()
+		head := lagging.head
+		lagging.mu.Unlock()
+		if head == parent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lagging EL did not catch up, head %x", head)
+		}
+	}
+	for n := 1; n <= 6; n++ {
+		if !lagging.known[common.Hash{byte(n)}] {
+			t.Errorf("block %d missing", n)
+		}
+	}
+	if primary.calls != 12 {
+		t.Errorf("primary got %d calls, want 12", primary.calls)
+	}
+}
+
+func TestCatchUpTooFarBehind(t *testing.T) {
+	var (
+		primary = newMockEL("primary")
+		lagging = &syncEL{mockEL: newMockEL("lagging"), known: map[common.Hash]bool{}}
+		relay   = newRelay([]ElApi{primary, lagging})
+	)
+	defer relay.Close()
+
+	payload := engine.ExecutableData{Number: 100, ParentHash: common.Hash{99}, BlockHash: common.Hash{100}}
+	call := &payloadCall{engine.PayloadV3, payload, nil, nil, nil}
+	if _, err := relay.catchUp(lagging, call); !errors.Is(err, errCatchUpFailed) {
+		t.Fatalf("have %v, want %v", err, errCatchUpFailed)
+	}
+}
+
+func TestCatchUpPrimary(t *testing.T) {
+	var (
+		primary = &syncEL{mockEL: newMockEL("primary"), hold: 3, known: map[common.Hash]bool{{}: true}}
+		other   = newMockEL("other")
+		relay   = newRelay([]ElApi{primary, other})
+		parent  common.Hash
+	)
+	primary.gate = make(chan struct{})
+	defer relay.Close()
+	release := sync.OnceFunc(func() { close(primary.gate) })
+	defer release()
+
+	deliver := func(number uint64) engine.PayloadStatusV1 {
+		payload := engine.ExecutableData{Number: number, ParentHash: parent, BlockHash: common.Hash{byte(number)}}
+		status, _ := relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+		parent = payload.BlockHash
+		return status
+	}
+	deliver(1)
+	primary.setOffline(true)
+	deliver(2)
+	deliver(3)
+	primary.setOffline(false)
+	if status := deliver(4); status.Status != engine.SYNCING {
+		t.Fatalf("have status %v, want %v", status.Status, engine.SYNCING)
+	}
+	// The catch-up of the primary is stuck replaying block 3, the other EL
+	// answers meanwhile.
+	answered := make(chan engine.PayloadStatusV1, 1)
+	go func() { answered <- deliver(5) }()
+	select {
+	case status := <-answered:
+		if status.Status != engine.VALID {
+			t.Fatalf("have status %v, want %v", status.Status, engine.VALID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("catch-up of the primary holds up the relay")
+	}
+	release()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		primary.mu.Lock()
+		known := primary.known[parent]
+		primary.mu.Unlock()
+		if known {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("primary did not catch up")
+		}
+	}
+	if relay.selectPrimary() != primary {
+		t.Fatal("primary not restored after catch-up")
+	}
+}
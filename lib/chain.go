@@ -0,0 +1,80 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// chainWindow is a short window of recently seen blocks, keyed by block hash.
+// The blocks are linked through their parent hashes, which makes it possible
+// to tell whether a new head extends the canonical chain or moves to another
+// branch.
+type chainWindow struct {
+	blocks map[common.Hash]*blockUpdate
+	head   *blockUpdate
+	size   uint64 // number of blocks below the head to retain
+}
+
+func newChainWindow(size uint64) *chainWindow {
+	return &chainWindow{
+		blocks: make(map[common.Hash]*blockUpdate),
+		size:   size,
+	}
+}
+
+// get returns the block with the given hash, or nil if it is not in the window.
+func (c *chainWindow) get(hash common.Hash) *blockUpdate {
+	return c.blocks[hash]
+}
+
+// add inserts a block in the window, without changing the head.
+func (c *chainWindow) add(block *blockUpdate) {
+	c.blocks[block.execData.BlockHash] = block
+}
+
+// setHead inserts the block and makes it the canonical head. Blocks too far
+// below the new head are dropped.
+func (c *chainWindow) setHead(block *blockUpdate) {
+	c.add(block)
+	c.head = block
+	if block.execData.Number <= c.size {
+		return
+	}
+	limit := block.execData.Number - c.size
+	for hash, b := range c.blocks {
+		if b.execData.Number < limit {
+			delete(c.blocks, hash)
+		}
+	}
+}
+
+// commonAncestor returns the most recent block that both a and b descend from,
+// or nil if they don't meet within the window. A block counts as an ancestor
+// of itself.
+func (c *chainWindow) commonAncestor(a, b *blockUpdate) *blockUpdate {
+	seen := make(map[common.Hash]bool)
+	for block := a; block != nil; block = c.get(block.execData.ParentHash) {
+		seen[block.execData.BlockHash] = true
+	}
+	for block := b; block != nil; block = c.get(block.execData.ParentHash) {
+		if seen[block.execData.BlockHash] {
+			return block
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// makeChain creates a chain of n blocks on top of parent, with the given
+// branch tag mixed into the hashes.
+func makeChain(parent *blockUpdate, n int, branch byte) []*blockUpdate {
+	var (
+		blocks     []*blockUpdate
+		number     uint64
+		parentHash common.Hash
+	)
+	if parent != nil {
+		number, parentHash = parent.execData.Number+1, parent.execData.BlockHash
+	}
+	for i := 0; i < n; i++ {
+		block := &blockUpdate{execData: engine.ExecutableData{
+			Number:     number,
+			ParentHash: parentHash,
+			BlockHash:  common.Hash{branch, byte(number >> 8), byte(number)},
+		}}
+		blocks = append(blocks, block)
+		number, parentHash = number+1, block.execData.BlockHash
+	}
+	return blocks
+}
+
+func TestChainWindowReorg(t *testing.T) {
+	c := newChainWindow(16)
+	canon := makeChain(nil, 10, 'a')
+	for _, block := range canon {
+		c.setHead(block)
+	}
+	// Fork off at block 7, and build a longer side chain.
+	side := makeChain(canon[7], 4, 'b')
+	for _, block := range side {
+		c.add(block)
+	}
+	if have := c.commonAncestor(c.head, side[3]); have != canon[7] {
+		t.Fatalf("wrong ancestor: have %v, want 7", have.execData.Number)
+	}
+	// Extending the head: the ancestor is the head itself.
+	if have := c.commonAncestor(canon[9], canon[9]); have != canon[9] {
+		t.Fatalf("wrong ancestor: have %v, want 9", have.execData.Number)
+	}
+	// Rewinding to an ancestor of the head.
+	if have := c.commonAncestor(c.head, canon[5]); have != canon[5] {
+		t.Fatalf("wrong ancestor: have %v, want 5", have.execData.Number)
+	}
+	// Unknown blocks don't connect.
+	if have := c.commonAncestor(c.head, makeChain(nil, 1, 'c')[0]); have != nil {
+		t.Fatalf("unexpected ancestor %v", have.execData.Number)
+	}
+}
+
+func TestChainWindowPrune(t *testing.T) {
+	c := newChainWindow(4)
+	blocks := makeChain(nil, 10, 'a')
+	for _, block := range blocks {
+		c.setHead(block)
+	}
+	for i, block := range blocks {
+		if have, want := c.get(block.execData.BlockHash) != nil, i >= 5; have != want {
+			t.Errorf("block %d: have retained %v, want %v", i, have, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/naoina/toml"
+)
+
+// LoadConfig reads and validates the TOML configuration file.
+func LoadConfig(file string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// Validate checks the configuration for errors which would prevent Factor from
+// running with it.
+func (c *Config) Validate() error {
+	if len(c.ElClients) == 0 {
+		return errors.New("no EL client configured")
+	}
+	var (
+		names            = make(map[string]bool)
+		primary, builder string
+	)
+	for i, el := range c.ElClients {
+		switch {
+		case el.Name == "":
+			return fmt.Errorf("EL client %d has no name", i)
+		case names[el.Name]:
+			return fmt.Errorf("duplicate EL client %q", el.Name)
+		case el.Address == "":
+			return fmt.Errorf("EL client %q has no address", el.Name)
+		case el.Primary && primary != "":
+			return fmt.Errorf("multiple primary ELs: %s and %s", primary, el.Name)
+		case el.Builder && builder != "":
+			return fmt.Errorf("multiple builder ELs: %s and %s", builder, el.Name)
+		}
+		names[el.Name] = true
+		if el.Primary {
+			primary = el.Name
+		}
+		if el.Builder {
+			builder = el.Name
+		}
+	}
+	if c.Passive.Listen != "" {
+		if len(common.FromHex(c.Passive.JwtSecret)) != 32 {
+			return errors.New("passive mode requires a 32 byte jwt secret")
+		}
+		return nil
+	}
+	sources := c.clSources()
+	if len(sources) == 0 {
+		return errors.New("no CL client configured")
+	}
+	clear(names)
+	for _, cl := range sources {
+		switch {
+		case cl.Address == "":
+			return fmt.Errorf("CL client %q has no address", cl.Name)
+		case names[cl.Name]:
+			return fmt.Errorf("duplicate CL client %q", cl.Name)
+		}
+		names[cl.Name] = true
+	}
+	if c.Verify.Network != "" {
+		if _, err := lightChainConfig(c.Verify.Network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clSources returns the configured CL clients in order of preference.
+func (c *Config) clSources() []CLConfig {
+	configs := slices.Clone(c.ClClients)
+	if c.ClClient.Address != "" {
+		configs = append([]CLConfig{c.ClClient}, configs...)
+	}
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configs[i].Priority < configs[j].Priority
+	})
+	return configs
+}
+
+// warnRestart warns about the settings which changed between the running and
+// the next configuration, but can't be applied without a restart.
+func warnRestart(running, next Config, fields ...string) {
+	var changed []string
+	rv, nv := reflect.ValueOf(running), reflect.ValueOf(next)
+	for _, field := range fields {
+		if !reflect.DeepEqual(rv.FieldByName(field).Interface(), nv.FieldByName(field).Interface()) {
+			changed = append(changed, field)
+		}
+	}
+	if len(changed) > 0 {
+		log.Warn("Config changes require a restart", "settings", changed)
+	}
+}
+
+// ApplyConfig adds, removes and replaces ELs to match the next configuration.
+// ELs whose settings changed are replaced with new connections. It returns the
+// configuration in effect afterwards: changes which failed or need a restart
+// are left out.
+func (r *relayPI) ApplyConfig(running, next Config) Config {
+	warnRestart(running, next, "DivergenceDir", "Passive", "Admin", "Metrics")
+
+	applied := slices.Clone(running.ElClients)
+	index := func(name string) int {
+		return slices.IndexFunc(applied, func(c ELConfig) bool { return c.Name == name })
+	}
+	// Add first, so that the last EL is never removed.
+	for _, conf := range next.ElClients {
+		i := index(conf.Name)
+		switch {
+		case i < 0:
+			if err := r.AddEL(conf); err != nil {
+				log.Error("Failed to add EL", "el", conf.Name, "err", err)
+				continue
+			}
+			applied = append(applied, conf)
+		case !reflect.DeepEqual(applied[i], conf):
+			if err := r.ReplaceEL(conf); err != nil {
+				log.Error("Failed to replace EL", "el", conf.Name, "err", err)
+				continue
+			}
+			applied[i] = conf
+		}
+	}
+	for _, conf := range running.ElClients {
+		if slices.ContainsFunc(next.ElClients, func(c ELConfig) bool { return c.Name == conf.Name }) {
+			continue
+		}
+		if err := r.RemoveEL(conf.Name); err != nil {
+			log.Error("Failed to remove EL", "el", conf.Name, "err", err)
+			continue
+		}
+		applied = slices.Delete(applied, index(conf.Name), index(conf.Name)+1)
+	}
+	running.ElClients = applied
+	return running
+}
+
+// ApplyConfig switches to the CL clients of the next configuration, if they
+// changed. The fetcher state is kept. It returns the configuration in effect
+// afterwards: changes which failed or need a restart are left out.
+func (f *fetcher) ApplyConfig(running, next Config) Config {
+	warnRestart(running, next, "BackfillDepth", "BadBlockDir", "BlobArchive", "Verify")
+
+	sources := next.clSources()
+	if reflect.DeepEqual(running.clSources(), sources) {
+		return running
+	}
+	if err := f.SetSources(sources); err != nil {
+		log.Error("Failed to change CL clients", "err", err)
+		return running
+	}
+	if f.verifier != nil {
+		log.Warn("Light client keeps using the CL clients it was started with until restart")
+	}
+	running.ClClients, running.ClClient = next.ClClients, next.ClClient
+	return running
+}
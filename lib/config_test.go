@@ -0,0 +1,177 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() Config {
+		return Config{
+			ElClients: []ELConfig{{Name: "a", Address: "http://a"}, {Name: "b", Address: "http://b"}},
+			ClClients: []CLConfig{{Name: "cl", Address: "http://cl"}},
+		}
+	}
+	for i, tt := range []struct {
+		modify func(c *Config)
+		valid  bool
+	}{
+		{func(c *Config) {}, true},
+		{func(c *Config) { c.ElClients = nil }, false},
+		{func(c *Config) { c.ElClients[1].Name = "a" }, false},
+		{func(c *Config) { c.ElClients[1].Name = "" }, false},
+		{func(c *Config) { c.ElClients[1].Address = "" }, false},
+		{func(c *Config) { c.ElClients[0].Primary, c.ElClients[1].Primary = true, true }, false},
+		{func(c *Config) { c.ElClients[0].Builder, c.ElClients[1].Builder = true, true }, false},
+		{func(c *Config) { c.ClClients = nil }, false},
+		{func(c *Config) { c.ClClients = nil; c.ClClient = CLConfig{Address: "http://cl"} }, true},
+		{func(c *Config) { c.ClClients = append(c.ClClients, c.ClClients[0]) }, false},
+		{func(c *Config) { c.Verify.Network = "nonet" }, false},
+		{func(c *Config) { c.ClClients = nil; c.Passive = PassiveConfig{Listen: ":8551"} }, false},
+		{func(c *Config) { c.ClClients = nil; c.Passive = PassiveConfig{Listen: ":8551", JwtSecret: "0x01"} }, false},
+		{func(c *Config) {
+			c.ClClients = nil
+			c.Passive = PassiveConfig{Listen: ":8551", JwtSecret: "0x0101010101010101010101010101010101010101010101010101010101010101"}
+		}, true},
+	} {
+		config := valid()
+		tt.modify(&config)
+		if err := config.Validate(); (err == nil) != tt.valid {
+			t.Errorf("test %d: have error %v, want valid %v", i, err, tt.valid)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "conf.toml")
+	os.WriteFile(file, []byte(`
+[[el_clients]]
+name = "a"
+address = "http://a"
+primary = true
+
+[[cl_clients]]
+name = "cl"
+address = "http://cl"
+`), 0644)
+	config, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.ElClients[0].Primary || config.ClClients[0].Address != "http://cl" {
+		t.Fatalf("wrong config: %+v", config)
+	}
+	// Invalid configs are rejected.
+	os.WriteFile(file, []byte(`
+[[cl_clients]]
+name = "cl"
+address = "http://cl"
+`), 0644)
+	if _, err := LoadConfig(file); err == nil {
+		t.Fatal("config without ELs accepted")
+	}
+}
+
+func TestRelayApplyConfig(t *testing.T) {
+	running := Config{ElClients: []ELConfig{
+		{Name: "a", Address: "http://localhost:1"},
+		{Name: "b", Address: "http://localhost:2"},
+	}}
+	relay, err := NewRelayPI(running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	els, _ := relay.snapshot()
+	a := els[0]
+
+	next := Config{ElClients: []ELConfig{
+		{Name: "a", Address: "http://localhost:1"},
+		{Name: "c", Address: "http://localhost:3"},
+		{Name: "b", Address: "http://localhost:2", Headers: map[string]string{"X-Key": "secret"}},
+	}}
+	applied := relay.ApplyConfig(running, next)
+	var names []string
+	els, _ = relay.snapshot()
+	for _, el := range els {
+		names = append(names, el.Name())
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("have ELs %v, want %v", names, want)
+	}
+	if els[0] != a {
+		t.Error("unchanged EL was replaced")
+	}
+	if len(applied.ElClients) != 3 || applied.ElClients[1].Headers["X-Key"] != "secret" {
+		t.Fatalf("wrong applied config: %+v", applied.ElClients)
+	}
+
+	applied = relay.ApplyConfig(applied, Config{ElClients: next.ElClients[1:]})
+	if have := relay.Primary(); have != "b" {
+		t.Fatalf("have primary %s, want b", have)
+	}
+	if len(applied.ElClients) != 2 {
+		t.Fatalf("wrong applied config: %+v", applied.ElClients)
+	}
+}
+
+func TestFetcherSetSources(t *testing.T) {
+	config := Config{ClClients: []CLConfig{
+		{Name: "a", Address: "http://a", Priority: 1},
+		{Name: "b", Address: "http://b", Priority: 2},
+	}}
+	f, err := NewFetcher(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := &blockUpdate{}
+	f.final = final
+	f.switchSource(f.cls[1])
+	b := f.cls[1]
+
+	// Unchanged sources are kept, and so is the active one.
+	next := Config{ClClients: []CLConfig{
+		{Name: "b", Address: "http://b", Priority: 2},
+		{Name: "c", Address: "http://c", Priority: 3},
+	}}
+	applied := f.ApplyConfig(config, next)
+	if !reflect.DeepEqual(applied.ClClients, next.ClClients) {
+		t.Fatalf("wrong applied config: %+v", applied.ClClients)
+	}
+	if f.source() != b || f.ActiveSource() != "b" {
+		t.Fatalf("active source changed to %s", f.ActiveSource())
+	}
+	// A changed active source is replaced by the most preferred one.
+	next = Config{ClClients: []CLConfig{
+		{Name: "b", Address: "http://b2", Priority: 2},
+		{Name: "c", Address: "http://c", Priority: 3},
+	}}
+	f.ApplyConfig(applied, next)
+	if f.source() == b || f.ActiveSource() != "b" {
+		t.Fatal("changed source not replaced")
+	}
+	if f.final != final {
+		t.Fatal("fetcher state lost")
+	}
+	if err := f.SetSources(nil); err == nil {
+		t.Fatal("empty sources accepted")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const defaultDivergenceDir = "divergences"
+
+// elAnswer is the answer of one EL to a relayed engine API call.
+type elAnswer struct {
+	EL              string                  `json:"el"`
+	Client          *engine.ClientVersionV1 `json:"client,omitempty"`
+	Status          string                  `json:"status,omitempty"`
+	LatestValidHash *common.Hash            `json:"latestValidHash,omitempty"`
+	ValidationError *string                 `json:"validationError,omitempty"`
+	Error           string                  `json:"error,omitempty"`
+}
+
+func newAnswer(el ElApi, status engine.PayloadStatusV1, err error) elAnswer {
+	if err != nil {
+		return elAnswer{EL: el.Name(), Client: clientVersion(el), Error: err.Error()}
+	}
+	return elAnswer{
+		EL:              el.Name(),
+		Client:          clientVersion(el),
+		Status:          status.Status,
+		LatestValidHash: status.LatestValidHash,
+		ValidationError: status.ValidationError,
+	}
+}
+
+// String formats the answer for logging.
+func (a elAnswer) String() string {
+	if a.Error != "" {
+		return "error: " + a.Error
+	}
+	s := a.Status
+	if a.LatestValidHash != nil {
+		s += " lvh=" + a.LatestValidHash.TerminalString()
+	}
+	if a.ValidationError != nil {
+		s += " err=" + *a.ValidationError
+	}
+	return s
+}
+
+// divergence is raised when the ELs disagree on a block.
+type divergence struct {
+	Time    time.Time       `json:"time"`
+	Method  string          `json:"method"`
+	Number  uint64          `json:"number"`
+	Hash    common.Hash     `json:"hash"`
+	Answers []elAnswer      `json:"answers"`
+	Payload json.RawMessage `json:"payload"` // parameters of the call
+}
+
+// diverges reports whether the answers disagree. Only conclusive answers are
+// compared: those with status VALID or INVALID. They disagree if the status
+// differs, or if the latest valid hashes differ.
+func diverges(answers []elAnswer) bool {
+	var first *elAnswer
+	for i := range answers {
+		a := &answers[i]
+		if a.Error != "" || (a.Status != engine.VALID && a.Status != engine.INVALID) {
+			continue
+		}
+		if first == nil {
+			first = a
+			continue
+		}
+		if a.Status != first.Status {
+			return true
+		}
+		if a.LatestValidHash != nil && first.LatestValidHash != nil && *a.LatestValidHash != *first.LatestValidHash {
+			return true
+		}
+	}
+	return false
+}
+
+// divergenceTracker collects the answers of the ELs to relayed calls, which
+// arrive asynchronously, and checks them for divergence once all are in.
+type divergenceTracker struct {
+	onDivergence func(*divergence)
+
+	mu      sync.Mutex
+	pending map[common.Hash][]*trackedCall // calls awaiting answers, by block hash
+}
+
+// trackedCall is a call for which answers are being collected.
+type trackedCall struct {
+	divergence
+	payload interface{} // call parameters, only encoded on divergence
+	missing int         // number of answers still missing
+}
+
+func newDivergenceTracker(onDivergence func(*divergence)) *divergenceTracker {
+	return &divergenceTracker{
+		onDivergence: onDivergence,
+		pending:      make(map[common.Hash][]*trackedCall),
+	}
+}
+
+// track starts collecting the answers of the given ELs to a call. The returned
+// function records the answer of the EL at the given index.
+func (t *divergenceTracker) track(method string, number uint64, hash common.Hash, payload interface{}, els []string) func(int, elAnswer) {
+	call := &trackedCall{
+		divergence: divergence{
+			Time:    time.Now(),
+			Method:  method,
+			Number:  number,
+			Hash:    hash,
+			Answers: make([]elAnswer, len(els)),
+		},
+		payload: payload,
+		missing: len(els),
+	}
+	for i, name := range els {
+		call.Answers[i].EL = name
+	}
+	t.mu.Lock()
+	t.pending[hash] = append(t.pending[hash], call)
+	t.mu.Unlock()
+
+	return func(i int, answer elAnswer) {
+		t.mu.Lock()
+		call.Answers[i] = answer
+		call.missing--
+		done := call.missing == 0
+		if done {
+			t.remove(call)
+		}
+		t.mu.Unlock()
+		if done {
+			t.check(call)
+		}
+	}
+}
+
+// remove drops a completed call. The lock must be held.
+func (t *divergenceTracker) remove(call *trackedCall) {
+	calls := t.pending[call.Hash]
+	for i, c := range calls {
+		if c == call {
+			calls = append(calls[:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(calls) == 0 {
+		delete(t.pending, call.Hash)
+	} else {
+		t.pending[call.Hash] = calls
+	}
+}
+
+// Pending returns the number of blocks with calls awaiting answers.
+func (t *divergenceTracker) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+func (t *divergenceTracker) check(call *trackedCall) {
+	if !diverges(call.Answers) {
+		return
+	}
+	d := call.divergence
+	var err error
+	if d.Payload, err = json.Marshal(call.payload); err != nil {
+		log.Error("Failed to encode divergent payload", "err", err)
+	}
+	t.onDivergence(&d)
+}
+
+// report logs the divergence, and writes it as JSON to the given directory.
+func (d *divergence) report(dir string) {
+	ctx := []interface{}{"method", d.Method, "number", d.Number, "hash", d.Hash}
+	for _, a := range d.Answers {
+		ctx = append(ctx, identity(a.EL, a.Client), a.String())
+	}
+	log.Error("Consensus divergence detected", ctx...)
+
+	enc, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		log.Error("Failed to encode divergence", "err", err)
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Error("Failed to create divergence directory", "err", err)
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("divergence-%d-%s-%s.json", d.Number, d.Hash.Hex(), d.Method))
+	if err := os.WriteFile(path, enc, 0644); err != nil {
+		log.Error("Failed to write divergence report", "err", err)
+		return
+	}
+	log.Error("Wrote divergence report", "path", path)
+}
@@ -17,31 +17,70 @@
 package lib
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/beacon/engine"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
 	"github.com/ethereum/go-ethereum/log"
 )
 
 type blockUpdate struct {
+	fork            fork
+	slot            uint64
 	execData        engine.ExecutableData
 	beaconRoot      common.Hash
 	versionedHashes []common.Hash
+	requests        [][]byte
 }
 
-func NewBlockUpdate(block engine.ExecutableData, beaconRoot common.Hash) (*blockUpdate, error) {
-	versionedHashes, err := decodeBlobHashes(block.Transactions)
+// errBadBlock is returned by NewBlockUpdate if the block does not pass local
+// verification, which usually means that Factor decoded it incorrectly.
+var errBadBlock = errors.New("block verification failed")
+
+// errUnverified is returned in verified mode if the CL serves a block which
+// does not match the one attested by the sync committee.
+var errUnverified = errors.New("block not attested by sync committee")
+
+// NewBlockUpdate creates the update for a block fetched from the CL. The block
+// is rebuilt locally, to verify that its hash matches before it is delivered.
+func NewBlockUpdate(block *clBlock) (*blockUpdate, error) {
+	versionedHashes, err := decodeBlobHashes(block.execData.Transactions)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errBadBlock, err)
+	}
+	var beaconRoot *common.Hash
+	if block.fork >= forkDeneb {
+		beaconRoot = &block.parentRoot
+		// The versioned hashes must also match the commitments in the beacon
+		// block, else the EL could be checking against a misread transaction.
+		if err := checkBlobHashes(versionedHashes, block.commitments); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadBlock, err)
+		}
+	}
+	if _, err := engine.ExecutableDataToBlock(block.execData, versionedHashes, beaconRoot, block.requests); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadBlock, err)
 	}
 	return &blockUpdate{
-		execData:        block,
-		beaconRoot:      beaconRoot,
+		fork:            block.fork,
+		slot:            block.slot,
+		execData:        block.execData,
+		beaconRoot:      block.parentRoot,
 		versionedHashes: versionedHashes,
+		requests:        block.requests,
 	}, nil
 }
 
@@ -57,131 +96,746 @@ func decodeBlobHashes(enc [][]byte) ([]common.Hash, error) {
 	return blobHashes, nil
 }
 
+// checkBlobHashes checks that the versioned hashes of the blob transactions
+// are the ones derived from the blob commitments, in order.
+func checkBlobHashes(versionedHashes []common.Hash, commitments []kzg4844.Commitment) error {
+	if len(versionedHashes) != len(commitments) {
+		return fmt.Errorf("%d blob hashes in transactions, %d commitments", len(versionedHashes), len(commitments))
+	}
+	hasher := sha256.New()
+	for i := range commitments {
+		if have := common.Hash(kzg4844.CalcBlobHashV1(hasher, &commitments[i])); have != versionedHashes[i] {
+			return fmt.Errorf("blob %d: commitment hash %v, transaction hash %v", i, have, versionedHashes[i])
+		}
+	}
+	return nil
+}
+
+const (
+	pollInterval       = 10 * time.Second // head polling interval without event stream
+	streamPollInterval = time.Minute      // safety-net polling interval while streaming
+	errorInterval      = 30 * time.Second // retry interval after a failed fetch
+	reconnectInterval  = 5 * time.Second  // event stream reconnect interval
+	healthInterval     = 30 * time.Second // CL source health check interval
+	staleHeadTimeout   = 2 * time.Minute  // time without new head before a CL source is considered stuck
+
+	defaultBackfillDepth = 32
+	defaultBadBlockDir   = "badblocks"
+	chainWindowSize      = 128 // minimum number of blocks kept in the chain window
+)
+
+// eventTopics are the CL event stream topics the fetcher subscribes to.
+var eventTopics = []string{"head", "finalized_checkpoint", "chain_reorg"}
+
 // fetcher fetches data from the remote CL, and feeds it to the EL sink.
 type fetcher struct {
-	cl      *remoteCL
-	sink    ElApi
-	wg      sync.WaitGroup
-	closeCh chan bool
-	finalCh chan blockUpdate
-	headCh  chan blockUpdate
+	sink          ElApi
+	backfillDepth int
+	badBlockDir   string // directory where responses failing verification are written
+	wg            sync.WaitGroup
+	closeCh       chan bool
+	eventCh       chan clEvent
+	streaming     atomic.Bool   // whether the event stream is currently connected
+	streamDown    chan struct{} // signals the fetchLoop that the event stream dropped
+	finalCh       chan blockUpdate
+	safeCh        chan blockUpdate
+	headCh        chan blockUpdate
+	verifier      *lightVerifier // light client, if running in verified mode
+	blobs         *blobArchive   // blob archive, if enabled
+	archiveCh     chan *blockUpdate
+
+	mu           sync.Mutex
+	cls          []*remoteCL        // CL sources, in order of preference
+	active       int                // index of the CL source in use
+	lastAdvance  time.Time          // time of the last new head
+	cancelStream context.CancelFunc // closes the event stream of the active source
+	lastHead     *blockRef          // last fetched head, for status reporting
+	lastFinal    *blockRef          // last fetched finalized block, for status reporting
+
+	final *blockUpdate // last finalized block, only accessed by fetchLoop
+	safe  common.Hash  // beacon root of the last justified checkpoint, only accessed by fetchLoop
+	chain *chainWindow // recently delivered blocks, only accessed by fetchLoop
 }
 
-func NewFetcher(config CLConfig, sink ElApi) (*fetcher, error) {
-	cl, err := newRemoteCL(config.Address, config.Name, config.Headers)
-	if err != nil {
-		return nil, err
+func NewFetcher(config Config, sink ElApi) (*fetcher, error) {
+	configs := config.clSources()
+	if len(configs) == 0 {
+		return nil, errors.New("no CL client configured")
 	}
-	return &fetcher{
-		cl:      cl,
-		sink:    sink,
-		closeCh: make(chan bool),
-		finalCh: make(chan blockUpdate, 10),
-		headCh:  make(chan blockUpdate, 10),
-	}, nil
+	var cls []*remoteCL
+	for _, conf := range configs {
+		cl, err := newRemoteCL(conf.Address, conf.Name, conf.Headers)
+		if err != nil {
+			return nil, err
+		}
+		cls = append(cls, cl)
+	}
+	f := &fetcher{
+		cls:           cls,
+		sink:          sink,
+		backfillDepth: defaultBackfillDepth,
+		badBlockDir:   defaultBadBlockDir,
+		closeCh:       make(chan bool),
+		eventCh:       make(chan clEvent, 16),
+		streamDown:    make(chan struct{}, 1),
+		finalCh:       make(chan blockUpdate, 10),
+		safeCh:        make(chan blockUpdate, 10),
+		headCh:        make(chan blockUpdate, 10),
+		archiveCh:     make(chan *blockUpdate, 16),
+		lastAdvance:   time.Now(),
+	}
+	if config.BackfillDepth > 0 {
+		f.backfillDepth = config.BackfillDepth
+	}
+	if config.BadBlockDir != "" {
+		f.badBlockDir = config.BadBlockDir
+	}
+	windowSize := chainWindowSize
+	if f.backfillDepth > windowSize {
+		windowSize = f.backfillDepth
+	}
+	f.chain = newChainWindow(uint64(windowSize))
+	if config.BlobArchive != "" {
+		blobs, err := newBlobArchive(config.BlobArchive)
+		if err != nil {
+			return nil, err
+		}
+		f.blobs = blobs
+	}
+	if config.Verify.Network != "" {
+		verifier, err := newLightVerifier(config.Verify, configs)
+		if err != nil {
+			return nil, err
+		}
+		f.verifier = verifier
+	}
+	return f, nil
 }
 
 func (f *fetcher) Start() {
-	f.wg.Add(2)
+	log.Info("Using CL source", "name", f.ActiveSource())
+	if f.verifier != nil {
+		f.verifier.Start()
+	}
+	f.wg.Add(4)
+	go f.eventLoop()
 	go f.fetchLoop()
 	go f.deliverLoop()
+	go f.healthLoop()
+	if f.blobs != nil {
+		f.wg.Add(1)
+		go f.archiveLoop()
+	}
 }
 
 func (f *fetcher) Stop() {
 	close(f.closeCh)
 	f.wg.Wait()
+	if f.verifier != nil {
+		f.verifier.Stop()
+	}
 }
 
-// loop runs the fetcher loop, which fetches new heads and finalized blocks
-// from the CL node, and emits them over the finalCh and headCh.
-func (f *fetcher) fetchLoop() {
-	defer f.wg.Done()
+// ActiveSource returns the name of the CL source currently in use.
+func (f *fetcher) ActiveSource() string {
+	return f.source().name
+}
 
-	var (
-		timer = time.NewTimer(10 * time.Second)
-		final *blockUpdate
-		head  *blockUpdate
-	)
-	defer timer.Stop()
+// source returns the CL source currently in use.
+func (f *fetcher) source() *remoteCL {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cls[f.active]
+}
 
-	for {
-		if fBlock, fBeaconRoot, err := f.cl.GetFinalizedBlock(); err != nil {
-			log.Error("Failed fetching finalized", "err", err)
-			timer.Reset(30 * time.Second)
-			select {
-			case <-timer.C:
-			case <-f.closeCh:
-				return
+// SetSources replaces the CL sources. Sources which are configured as before
+// are kept, and so is the active one if it is still present. Otherwise the most
+// preferred source is used. The blocks already fetched and delivered are kept.
+func (f *fetcher) SetSources(configs []CLConfig) error {
+	if len(configs) == 0 {
+		return errors.New("no CL client configured")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cls := make([]*remoteCL, len(configs))
+	for i, conf := range configs {
+		for _, cl := range f.cls {
+			if cl.name == conf.Name && cl.address == conf.Address && maps.Equal(cl.customHeaders, conf.Headers) {
+				cls[i] = cl
 			}
-		} else if fBlock.Number != 0 && (final == nil || fBlock.Number != final.execData.Number) {
-			update, err := NewBlockUpdate(fBlock, fBeaconRoot)
+		}
+		if cls[i] == nil {
+			cl, err := newRemoteCL(conf.Address, conf.Name, conf.Headers)
 			if err != nil {
-				log.Error("Error parsing versioned hashes", "err", err)
-				continue
+				return err
 			}
-			final = update // New finalized
-			log.Info("New final block",
-				"number", final.execData.Number,
-				"hash", final.execData.BlockHash,
-				"beaconRoot", final.beaconRoot)
+			cls[i] = cl
+		}
+	}
+	active := slices.Index(cls, f.cls[f.active])
+	if active < 0 {
+		log.Warn("Switching CL source", "from", f.cls[f.active].name, "to", cls[0].name)
+		active = 0
+		f.lastAdvance = time.Now()
+		if f.cancelStream != nil {
+			f.cancelStream()
+		}
+	}
+	f.cls, f.active = cls, active
+	log.Info("Updated CL sources", "count", len(cls), "active", cls[active].name)
+	return nil
+}
 
-			select {
-			case f.finalCh <- *final:
-			default:
+// sources returns the CL sources, and the index of the active one.
+func (f *fetcher) sources() ([]*remoteCL, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cls, f.active
+}
+
+// healthLoop periodically checks the CL sources, and switches to the most
+// preferred healthy one.
+func (f *fetcher) healthLoop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.checkSources(false)
+		case <-f.closeCh:
+			return
+		}
+	}
+}
+
+// checkSources switches to the most preferred CL source which is healthy. The
+// active source is skipped if it failed, or if it has not delivered a new head
+// for a while.
+func (f *fetcher) checkSources(activeFailed bool) {
+	cls, active := f.sources()
+	f.mu.Lock()
+	stale := time.Since(f.lastAdvance) > staleHeadTimeout
+	f.mu.Unlock()
+
+	for i, cl := range cls {
+		if i == active && (activeFailed || stale) {
+			if stale {
+				log.Warn("CL source stopped advancing", "name", cl.name)
 			}
+			continue
+		}
+		if err := cl.CheckHealth(); err != nil {
+			log.Debug("CL source unhealthy", "name", cl.name, "err", err)
+			continue
 		}
-		if hBlock, hBeaconRoot, err := f.cl.GetHeadBlock(); err != nil {
-			log.Error("Failed fetching head", "err", err)
-			timer.Reset(30 * time.Second)
+		if i != active {
+			f.switchSource(cl)
+		}
+		return
+	}
+	if len(cls) > 1 {
+		log.Warn("No healthy CL source to switch to", "active", cls[active].name)
+	}
+}
+
+// switchSource makes the given CL source the active one, and reconnects the
+// event stream. Sources which have been removed meanwhile are ignored.
+func (f *fetcher) switchSource(cl *remoteCL) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	index := slices.Index(f.cls, cl)
+	if index < 0 {
+		return
+	}
+	log.Warn("Switching CL source", "from", f.cls[f.active].name, "to", cl.name)
+	f.active = index
+	f.lastAdvance = time.Now()
+	if f.cancelStream != nil {
+		f.cancelStream()
+	}
+}
+
+// eventLoop keeps a subscription to the CL event stream open, and forwards
+// the events to the fetchLoop. If the stream cannot be established, it keeps
+// retrying, while the fetchLoop falls back to polling.
+func (f *fetcher) eventLoop() {
+	defer f.wg.Done()
+
+	closeCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-f.closeCh
+		cancel()
+	}()
+	for {
+		f.mu.Lock()
+		cl := f.cls[f.active]
+		ctx, cancelStream := context.WithCancel(closeCtx)
+		f.cancelStream = cancelStream
+		f.mu.Unlock()
+
+		stream, err := cl.SubscribeEvents(ctx, eventTopics)
+		if err != nil {
+			log.Warn("CL event stream unavailable, polling", "name", cl.name, "err", err)
+		} else {
+			log.Info("Subscribed to CL event stream", "name", cl.name)
+			f.streaming.Store(true)
+			err = f.forwardEvents(stream)
+			f.streaming.Store(false)
+			stream.Close()
+			log.Warn("CL event stream disconnected", "name", cl.name, "err", err)
+			// Fall back to polling right away, instead of after the long
+			// interval used while streaming.
 			select {
-			case <-timer.C:
-			case <-f.closeCh:
-				return
+			case f.streamDown <- struct{}{}:
+			default:
 			}
-		} else if hBlock.Number != 0 && (head == nil || hBlock.Number != head.execData.Number) {
-			update, err := NewBlockUpdate(hBlock, hBeaconRoot)
-			if err != nil {
-				log.Error("Error parsing versioned hashes", "err", err)
+		}
+		cancelStream()
+		select {
+		case <-time.After(reconnectInterval):
+		case <-f.closeCh:
+			return
+		}
+	}
+}
+
+// forwardEvents reads events from the stream until it fails.
+func (f *fetcher) forwardEvents(stream *eventStream) error {
+	for {
+		ev, err := stream.Next()
+		if err != nil {
+			return err
+		}
+		select {
+		case f.eventCh <- ev:
+		case <-f.closeCh:
+			return errors.New("fetcher stopped")
+		}
+	}
+}
+
+// fetchLoop runs the fetcher loop, which fetches new heads, justified and
+// finalized blocks from the CL node, and emits them over the headCh, safeCh
+// and finalCh. Fetches are triggered by the CL event stream, by the light
+// client in verified mode, or by a timer if the stream is down.
+func (f *fetcher) fetchLoop() {
+	defer f.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var verified <-chan struct{}
+	if f.verifier != nil {
+		verified = f.verifier.updateCh
+	}
+	for {
+		var fetchFinal, fetchHead bool
+		select {
+		case <-timer.C:
+			fetchFinal, fetchHead = true, true
+		case <-verified:
+			fetchFinal, fetchHead = true, true
+		case <-f.streamDown:
+			fetchFinal, fetchHead = true, true
+		case ev := <-f.eventCh:
+			switch ev.Topic {
+			case "head":
+				var head headEvent
+				if err := json.Unmarshal(ev.Data, &head); err == nil {
+					log.Debug("CL head event", "slot", uint64(head.Slot), "root", head.Block)
+					// Justification can only change at epoch boundaries.
+					fetchFinal = head.EpochTransition
+				}
+				fetchHead = true
+			case "chain_reorg":
+				var reorg chainReorgEvent
+				if err := json.Unmarshal(ev.Data, &reorg); err == nil {
+					log.Info("CL chain reorg event", "slot", uint64(reorg.Slot), "depth", uint64(reorg.Depth),
+						"old", reorg.OldHeadBlock, "new", reorg.NewHeadBlock)
+				}
+				fetchHead = true
+			case "finalized_checkpoint":
+				fetchFinal = true
+			default:
 				continue
 			}
-			head = update // New head
-			log.Info("New head block",
-				"number", head.execData.Number,
-				"hash", head.execData.BlockHash,
-				"beaconRoot", head.beaconRoot)
+		case <-f.closeCh:
+			return
+		}
+		wait := pollInterval
+		if f.streaming.Load() {
+			wait = streamPollInterval
+		}
+		var failed bool
+		if fetchFinal {
+			if err := f.fetchFinal(); err != nil {
+				log.Error("Failed fetching finalized", "source", f.ActiveSource(), "err", err)
+				fetchFailureMeter.Inc(1)
+				failed = true
+			}
+			if err := f.fetchSafe(); err != nil {
+				log.Error("Failed fetching justified", "source", f.ActiveSource(), "err", err)
+				fetchFailureMeter.Inc(1)
+				failed = true
+			}
+		}
+		if fetchHead {
+			if err := f.fetchHead(); err != nil {
+				log.Error("Failed fetching head", "source", f.ActiveSource(), "err", err)
+				fetchFailureMeter.Inc(1)
+				failed = true
+			}
+		}
+		if failed {
+			wait = errorInterval
+			if cls, _ := f.sources(); len(cls) > 1 {
+				// Retry quickly if there's another source to fail over to.
+				f.checkSources(true)
+				wait = pollInterval
+			}
+		}
+		if !timer.Stop() {
 			select {
-			case f.headCh <- *head:
+			case <-timer.C:
 			default:
 			}
 		}
-		timer.Reset(10 * time.Second)
+		timer.Reset(wait)
+	}
+}
+
+// fetchFinal fetches the finalized block, and emits it if it is new.
+func (f *fetcher) fetchFinal() error {
+	update, err := f.finalUpdate()
+	if err != nil || update == nil {
+		return err
+	}
+	f.final = update // New finalized
+	f.mu.Lock()
+	f.lastFinal = &blockRef{Number: update.execData.Number, Hash: update.execData.BlockHash}
+	f.mu.Unlock()
+	finalizedGauge.Update(int64(update.execData.Number))
+	log.Info("New final block",
+		"number", f.final.execData.Number,
+		"hash", f.final.execData.BlockHash,
+		"beaconRoot", f.final.beaconRoot)
+
+	select {
+	case f.finalCh <- *f.final:
+	default:
+		log.Warn("Delivery queue full, dropping finalized update", "number", f.final.execData.Number)
+		droppedFinalizedMeter.Inc(1)
+	}
+	return nil
+}
+
+// finalUpdate fetches the finalized block, or returns nil if it did not
+// change.
+func (f *fetcher) finalUpdate() (*blockUpdate, error) {
+	if f.verifier != nil {
+		final, ok := f.verifier.Finalized()
+		if !ok || (f.final != nil && final.blockHash == f.final.execData.BlockHash) {
+			return nil, nil
+		}
+		return f.fetchVerified(final)
+	}
+	fBlock, err := f.source().GetFinalizedBlock()
+	if err != nil {
+		return nil, err
+	}
+	if fBlock.execData.Number == 0 || (f.final != nil && fBlock.execData.Number == f.final.execData.Number) {
+		return nil, nil
+	}
+	return f.newBlockUpdate(fBlock)
+}
+
+// fetchSafe fetches the current justified checkpoint, and emits its block as
+// the safe block if it changed. In verified mode the justified checkpoint
+// cannot be verified, so the finalized block doubles as safe block.
+func (f *fetcher) fetchSafe() error {
+	if f.verifier != nil {
+		return nil
+	}
+	checkpoints, err := f.source().GetFinalityCheckpoints()
+	if err != nil {
+		return err
+	}
+	root := checkpoints.Data.CurrentJustified.Root
+	if root == (common.Hash{}) || root == f.safe {
+		return nil
+	}
+	update, err := f.fetchBlock(root.Hex())
+	if err != nil {
+		return err
+	}
+	if update.execData.Number == 0 {
+		return nil
+	}
+	f.safe = root // New justified
+	log.Info("New safe block",
+		"number", update.execData.Number,
+		"hash", update.execData.BlockHash,
+		"epoch", uint64(checkpoints.Data.CurrentJustified.Epoch))
+
+	select {
+	case f.safeCh <- *update:
+	default:
+		log.Warn("Delivery queue full, dropping safe update", "number", update.execData.Number)
+		droppedSafeMeter.Inc(1)
+	}
+	return nil
+}
+
+// fetchHead fetches the head block, and emits it if it is new. If the head
+// does not directly extend the previous one, the missing blocks of its branch
+// are emitted first.
+func (f *fetcher) fetchHead() error {
+	update, err := f.headUpdate()
+	if err != nil || update == nil {
+		return err
+	}
+	branch, err := f.resolveBranch(update)
+	if err != nil {
+		log.Warn("Failed fetching missing blocks", "err", err)
+	}
+	if prev := f.chain.head; prev != nil {
+		switch ancestor := f.chain.commonAncestor(prev, update); {
+		case ancestor == nil:
+			log.Warn("New head does not connect to known chain",
+				"number", update.execData.Number, "hash", update.execData.BlockHash)
+		case ancestor != prev:
+			log.Warn("Chain reorg detected",
+				"depth", prev.execData.Number-ancestor.execData.Number,
+				"oldNumber", prev.execData.Number, "oldHash", prev.execData.BlockHash,
+				"newNumber", update.execData.Number, "newHash", update.execData.BlockHash,
+				"ancestor", ancestor.execData.Number, "ancestorHash", ancestor.execData.BlockHash,
+				"missing", len(branch))
+		}
+	}
+	for _, block := range branch {
+		log.Info("Delivering missing block",
+			"number", block.execData.Number,
+			"hash", block.execData.BlockHash)
 		select {
-		case <-timer.C:
+		case f.headCh <- *block:
+		case <-f.closeCh:
+			return nil
+		}
+		f.archiveBlobs(block)
+	}
+	f.mu.Lock()
+	f.lastAdvance = time.Now()
+	f.lastHead = &blockRef{Number: update.execData.Number, Hash: update.execData.BlockHash}
+	f.mu.Unlock()
+	headGauge.Update(int64(update.execData.Number))
+	log.Info("New head block",
+		"number", update.execData.Number,
+		"hash", update.execData.BlockHash,
+		"beaconRoot", update.beaconRoot,
+		"fork", update.fork)
+	select {
+	case f.headCh <- *update:
+	default:
+		// The head is not recorded as delivered, so it is fetched again, or
+		// backfilled as the parent of the next head.
+		log.Warn("Delivery queue full, dropping head update", "number", update.execData.Number)
+		droppedHeadMeter.Inc(1)
+		return nil
+	}
+	f.chain.setHead(update) // New head
+	f.archiveBlobs(update)
+	return nil
+}
+
+// headUpdate fetches the head block, or returns nil if it did not change. In
+// verified mode, the head is the latest block attested by the sync committee.
+func (f *fetcher) headUpdate() (*blockUpdate, error) {
+	if f.verifier != nil {
+		head, ok := f.verifier.Head()
+		if !ok || (f.chain.head != nil && head.blockHash == f.chain.head.execData.BlockHash) {
+			return nil, nil
+		}
+		return f.fetchVerified(head)
+	}
+	hBlock, err := f.source().GetHeadBlock()
+	if err != nil {
+		return nil, err
+	}
+	if hBlock.execData.Number == 0 || (f.chain.head != nil && hBlock.execData.BlockHash == f.chain.head.execData.BlockHash) {
+		return nil, nil
+	}
+	return f.newBlockUpdate(hBlock)
+}
+
+// resolveBranch walks back from the given block through the beacon parent
+// roots, until it reaches a block in the chain window. The fetched blocks are
+// added to the window, and the ones which still need to be delivered before
+// the given block are returned, oldest first. At most backfillDepth blocks are
+// fetched. On failure, the blocks fetched so far are returned along with the
+// error.
+func (f *fetcher) resolveBranch(update *blockUpdate) ([]*blockUpdate, error) {
+	if f.chain.head == nil || f.chain.get(update.execData.BlockHash) != nil {
+		// Nothing to connect to, or the head moved to a known block.
+		return nil, nil
+	}
+	var (
+		branch []*blockUpdate
+		block  = update
+		err    error
+	)
+	for f.chain.get(block.execData.ParentHash) == nil {
+		if len(branch) == f.backfillDepth {
+			log.Warn("Backfill depth exceeded", "depth", f.backfillDepth,
+				"head", update.execData.Number, "last", f.chain.head.execData.Number)
+			break
+		}
+		if block.execData.Number <= 1 {
+			break
+		}
+		parentHash := block.execData.ParentHash
+		if block, err = f.fetchBlock(block.beaconRoot.Hex()); err != nil {
+			break
+		}
+		// The parent hash is covered by the child's block hash, so checking
+		// it extends verification of the head to its ancestors.
+		if block.execData.BlockHash != parentHash {
+			err = fmt.Errorf("%w: block %v, want parent %v", errUnverified, block.execData.BlockHash, parentHash)
+			break
+		}
+		f.chain.add(block)
+		branch = append(branch, block)
+	}
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+	return branch, err
+}
+
+// fetchBlock fetches the block with the given specifier from the active CL
+// source.
+func (f *fetcher) fetchBlock(specifier string) (*blockUpdate, error) {
+	block, err := f.source().GetBlock(specifier)
+	if err != nil {
+		return nil, err
+	}
+	return f.newBlockUpdate(block)
+}
+
+// fetchVerified fetches the block of a header verified by the light client, and
+// checks that its execution payload is the attested one. The payload hash
+// covers the full payload, so this also verifies the fields which are not in
+// the light client header.
+func (f *fetcher) fetchVerified(header verifiedHeader) (*blockUpdate, error) {
+	update, err := f.fetchBlock(header.beaconRoot.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if update.execData.BlockHash != header.blockHash {
+		return nil, fmt.Errorf("%w: slot %d, got %v, want %v", errUnverified, header.slot, update.execData.BlockHash, header.blockHash)
+	}
+	return update, nil
+}
+
+// archiveBlobs queues the blobs of a block for archiving, if enabled.
+func (f *fetcher) archiveBlobs(update *blockUpdate) {
+	if f.blobs == nil || len(update.versionedHashes) == 0 {
+		return
+	}
+	select {
+	case f.archiveCh <- update:
+	default:
+		log.Warn("Blob archive queue full, skipping block", "number", update.execData.Number)
+	}
+}
+
+// archiveLoop fetches the blob sidecars of queued blocks, and writes them to
+// the blob archive.
+func (f *fetcher) archiveLoop() {
+	defer f.wg.Done()
+
+	for {
+		select {
+		case update := <-f.archiveCh:
+			sidecars, err := f.source().GetBlobSidecars(strconv.FormatUint(update.slot, 10))
+			if err == nil {
+				err = f.blobs.Store(sidecars, update.versionedHashes)
+			}
+			if err != nil {
+				log.Warn("Failed archiving blobs", "number", update.execData.Number,
+					"hash", update.execData.BlockHash, "slot", update.slot, "err", err)
+				continue
+			}
+			log.Debug("Archived blobs", "number", update.execData.Number, "count", len(sidecars))
 		case <-f.closeCh:
 			return
 		}
 	}
 }
 
+// newBlockUpdate creates the update for a block. If the block fails
+// verification, the raw CL response is written to the bad block directory, so
+// the decoding can be debugged.
+func (f *fetcher) newBlockUpdate(block *clBlock) (*blockUpdate, error) {
+	update, err := NewBlockUpdate(block)
+	if err == nil || !errors.Is(err, errBadBlock) {
+		return update, err
+	}
+	log.Error("Refusing to deliver bad block", "number", block.execData.Number,
+		"hash", block.execData.BlockHash, "source", f.ActiveSource(), "err", err)
+	if err := os.MkdirAll(f.badBlockDir, 0755); err != nil {
+		log.Error("Failed to create bad block directory", "err", err)
+		return nil, err
+	}
+	path := filepath.Join(f.badBlockDir, fmt.Sprintf("block-%d-%s.%s", block.execData.Number, block.execData.BlockHash.Hex(), block.rawFormat))
+	if err := os.WriteFile(path, block.raw, 0644); err != nil {
+		log.Error("Failed to write bad block", "err", err)
+	} else {
+		log.Error("Wrote bad block response", "path", path)
+	}
+	return nil, err
+}
+
 func (f *fetcher) deliverLoop() {
 	defer f.wg.Done()
 
 	var (
 		lastHead      common.Hash
+		lastSafe      common.Hash
 		lastFinalized common.Hash
+		lastFork      fork // fork of the head, decides the engine API version
 	)
+	// forkchoice assembles the current forkchoice state. The finalized block
+	// is used as safe block until a justified checkpoint is known.
+	forkchoice := func() engine.ForkchoiceStateV1 {
+		msg := engine.ForkchoiceStateV1{
+			HeadBlockHash:      lastHead,
+			SafeBlockHash:      lastSafe,
+			FinalizedBlockHash: lastFinalized,
+		}
+		if msg.SafeBlockHash == (common.Hash{}) {
+			msg.SafeBlockHash = lastFinalized
+		}
+		return msg
+	}
 	for {
 		select {
 		case headUpdate := <-f.headCh:
 			head := headUpdate.execData
 			lastHead = head.BlockHash
-			f.sink.NewPayloadV3(head, headUpdate.versionedHashes, &headUpdate.beaconRoot)
+			lastFork = headUpdate.fork
+			f.sink.NewPayload(lastFork.payloadVersion(), head, headUpdate.versionedHashes, &headUpdate.beaconRoot, headUpdate.requests)
+			f.sink.ForkchoiceUpdated(lastFork.forkchoiceVersion(), forkchoice(), nil)
 
-			msg := engine.ForkchoiceStateV1{HeadBlockHash: lastHead}
-			if lastFinalized != (common.Hash{}) {
-				msg.FinalizedBlockHash = lastFinalized
+		case safeUpdate := <-f.safeCh:
+			lastSafe = safeUpdate.execData.BlockHash
+			if lastHead != (common.Hash{}) {
+				f.sink.ForkchoiceUpdated(lastFork.forkchoiceVersion(), forkchoice(), nil)
 			}
-			f.sink.ForkchoiceUpdatedV1(msg, nil)
 
 		case finalizedUpdate := <-f.finalCh:
 			finalized := finalizedUpdate.execData
@@ -191,11 +845,9 @@ func (f *fetcher) deliverLoop() {
 			// in case no event is received from the head channel.
 			if lastHead == (common.Hash{}) {
 				lastHead = finalized.BlockHash
+				lastFork = finalizedUpdate.fork
 			}
-			f.sink.ForkchoiceUpdatedV1(engine.ForkchoiceStateV1{
-				FinalizedBlockHash: finalized.BlockHash,
-				HeadBlockHash:      lastHead,
-			}, nil)
+			f.sink.ForkchoiceUpdated(lastFork.forkchoiceVersion(), forkchoice(), nil)
 
 		case <-f.closeCh:
 			return
@@ -18,11 +18,22 @@ package lib
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/beacon/engine"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
 )
 
 func TestParseHead(t *testing.T) {
@@ -34,11 +45,17 @@ func TestParseHead(t *testing.T) {
 	if err := json.Unmarshal(data, &block); err != nil {
 		t.Fatal(err)
 	}
+	if have, want := parseFork(block.Version), forkBellatrix; have != want {
+		t.Fatalf("wrong fork: have %v, want %v", have, want)
+	}
 	payload := block.Data.Message.Body.ExecutionPayload
-	payload2 := payload.toExecutableDataV1()
+	payload2 := payload.toExecutableData(forkBellatrix)
 	if have, want := payload2.BlockHash, common.HexToHash("0x1873367cf106a66be0fc94c2165aeebab012dc7e896911b2c0ccfc4eb947e2be"); have != want {
 		t.Fatalf("have %#x, want %#x", have, want)
 	}
+	if _, err := engine.ExecutableDataToBlock(payload2, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestParseHeadDencun(t *testing.T) {
@@ -51,13 +68,502 @@ func TestParseHeadDencun(t *testing.T) {
 		t.Fatal(err)
 	}
 	beaconRoot := block.Data.Message.ParentRoot
-	params := block.Data.Message.Body.ExecutionPayload.toExecutableDataV1()
+	if have, want := parseFork(block.Version), forkDeneb; have != want {
+		t.Fatalf("wrong fork: have %v, want %v", have, want)
+	}
+	params := block.Data.Message.Body.ExecutionPayload.toExecutableData(forkDeneb)
 	blobhashes, err := decodeBlobHashes(params.Transactions)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = engine.ExecutableDataToBlock(params, blobhashes, &beaconRoot)
+	_, err = engine.ExecutableDataToBlock(params, blobhashes, &beaconRoot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseHeadElectra(t *testing.T) {
+	for _, tt := range []struct {
+		file      string
+		wantHash  common.Hash
+		wantTypes []byte // request types present in the block
+	}{
+		{"electra_deposits.resp", common.HexToHash("0x1f2637170986346c7993d5adbadbebbf4c9ed89c6a4d2dff653db99c8c168076"), []byte{depositRequestType}},
+		{"electra_withdrawals.resp", common.HexToHash("0xf6730485a38be5ada3e110990a2c7adaabd2e8d4a49782134f1a8bfbc246a5d7"), []byte{withdrawalRequestType}},
+		{"electra_consolidations.resp", common.HexToHash("0xc8807f7a1f96b0a073ff27065776dd21eff6b7e64079c60bffd33f690efbb330"), []byte{consolidationRequestType}},
+	} {
+		data, err := os.ReadFile("./testdata/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var block bellatrixBlock
+		if err := json.Unmarshal(data, &block); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := parseFork(block.Version), forkElectra; have != want {
+			t.Fatalf("%s: wrong fork: have %v, want %v", tt.file, have, want)
+		}
+		beaconRoot := block.Data.Message.ParentRoot
+		params := block.Data.Message.Body.ExecutionPayload.toExecutableData(forkElectra)
+		blobhashes, err := decodeBlobHashes(params.Transactions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests, err := block.Data.Message.Body.ExecutionRequests.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(requests) != len(tt.wantTypes) {
+			t.Fatalf("%s: have %d request types, want %d", tt.file, len(requests), len(tt.wantTypes))
+		}
+		for i, typ := range tt.wantTypes {
+			if requests[i][0] != typ {
+				t.Fatalf("%s: request %d: have type %d, want %d", tt.file, i, requests[i][0], typ)
+			}
+		}
+		// The requests are part of the block hash, so a successful conversion
+		// proves they were encoded correctly.
+		b, err := engine.ExecutableDataToBlock(params, blobhashes, &beaconRoot, requests)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if b.Hash() != tt.wantHash {
+			t.Fatalf("%s: have hash %#x, want %#x", tt.file, b.Hash(), tt.wantHash)
+		}
+	}
+}
+
+func TestBlockUpdateVerification(t *testing.T) {
+	data, err := os.ReadFile("./testdata/dencun.resp")
 	if err != nil {
 		t.Fatal(err)
 	}
+	var internal bellatrixBlock
+	if err := json.Unmarshal(data, &internal); err != nil {
+		t.Fatal(err)
+	}
+	block := &clBlock{
+		fork:        forkDeneb,
+		parentRoot:  internal.Data.Message.ParentRoot,
+		execData:    internal.Data.Message.Body.ExecutionPayload.toExecutableData(forkDeneb),
+		commitments: internal.Data.Message.Body.BlobKzgCommitments,
+	}
+	if _, err := NewBlockUpdate(block); err != nil {
+		t.Fatal(err)
+	}
+	// A decoding error in any field changes the block hash.
+	block.execData.GasUsed++
+	if _, err := NewBlockUpdate(block); !errors.Is(err, errBadBlock) {
+		t.Fatalf("have %v, want %v", err, errBadBlock)
+	}
+	block.execData.GasUsed--
+	// Blob hashes which don't match the commitments.
+	block.commitments = []kzg4844.Commitment{{1}}
+	if _, err := NewBlockUpdate(block); !errors.Is(err, errBadBlock) {
+		t.Fatalf("have %v, want %v", err, errBadBlock)
+	}
+	block.commitments = nil
+	if _, err := NewBlockUpdate(block); !errors.Is(err, errBadBlock) {
+		t.Fatalf("have %v, want %v", err, errBadBlock)
+	}
+	block.commitments = internal.Data.Message.Body.BlobKzgCommitments
+	// Decoding the block as the wrong fork too.
+	block.fork = forkCapella
+	block.execData = internal.Data.Message.Body.ExecutionPayload.toExecutableData(forkCapella)
+	if _, err := NewBlockUpdate(block); !errors.Is(err, errBadBlock) {
+		t.Fatalf("have %v, want %v", err, errBadBlock)
+	}
+}
+
+// fakeBlock is a bellatrix block served by a fakeCL.
+type fakeBlock struct {
+	root       common.Hash // beacon block root
+	parentRoot common.Hash
+	data       engine.ExecutableData
+}
+
+// makeFakeChain creates a chain of n valid blocks on top of parent, with the
+// given branch tag mixed into the hashes.
+func makeFakeChain(parent *fakeBlock, n int, branch byte) []*fakeBlock {
+	var (
+		blocks []*fakeBlock
+		number = uint64(1)
+	)
+	for i := 0; i < n; i++ {
+		block := &fakeBlock{root: common.Hash{0xbe, branch, byte(number)}}
+		if parent != nil {
+			number = parent.data.Number + 1
+			block.root[2] = byte(number)
+			block.parentRoot = parent.root
+			block.data.ParentHash = parent.data.BlockHash
+		}
+		block.data.Number = number
+		block.data.GasLimit = 30_000_000
+		block.data.Timestamp = number * 12
+		block.data.ExtraData = []byte{branch}
+		block.data.BaseFeePerGas = big.NewInt(7)
+		block.data.LogsBloom = make([]byte, 256)
+		block.data.Transactions = [][]byte{}
+		b, err := engine.ExecutableDataToBlockNoHash(block.data, nil, nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		block.data.BlockHash = b.Hash()
+		blocks = append(blocks, block)
+		parent = block
+	}
+	return blocks
+}
+
+func (b *fakeBlock) response() []byte {
+	var resp bellatrixBlock
+	resp.Version = "bellatrix"
+	resp.Data.Message.Slot = math.HexOrDecimal64(b.data.Number)
+	resp.Data.Message.ParentRoot = b.parentRoot
+	resp.Data.Message.Body.ExecutionPayload = beaconBlock{
+		ParentHash:    b.data.ParentHash,
+		LogsBloom:     b.data.LogsBloom,
+		Number:        b.data.Number,
+		GasLimit:      b.data.GasLimit,
+		Timestamp:     b.data.Timestamp,
+		ExtraData:     b.data.ExtraData,
+		BaseFeePerGas: b.data.BaseFeePerGas,
+		BlockHash:     b.data.BlockHash,
+		Transactions:  b.data.Transactions,
+	}
+	enc, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+// fakeCL is a CL node serving the beacon API used by the fetcher.
+type fakeCL struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	blocks     map[string]*fakeBlock // by specifier: beacon root, "head" or "finalized"
+	fetched    []string              // specifiers of the fetched blocks
+	health     int
+	syncError  bool // whether the syncing endpoint fails
+	syncing    bool
+	optimistic bool
+	justified  common.Hash
+}
+
+func newFakeCL(t *testing.T) *fakeCL {
+	cl := &fakeCL{blocks: make(map[string]*fakeBlock), health: http.StatusOK}
+	cl.Server = httptest.NewServer(http.HandlerFunc(cl.serve))
+	t.Cleanup(cl.Close)
+	return cl
+}
+
+func (cl *fakeCL) serve(w http.ResponseWriter, r *http.Request) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/eth/v2/beacon/blocks/"):
+		id := strings.TrimPrefix(path, "/eth/v2/beacon/blocks/")
+		block, ok := cl.blocks[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		cl.fetched = append(cl.fetched, id)
+		w.Write(block.response())
+	case path == "/eth/v1/node/health":
+		w.WriteHeader(cl.health)
+	case path == "/eth/v1/node/syncing" && cl.syncError:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"code":500,"message":"internal error"}`)
+	case path == "/eth/v1/node/syncing":
+		fmt.Fprintf(w, `{"data":{"head_slot":"1","sync_distance":"0","is_syncing":%t,"is_optimistic":%t}}`, cl.syncing, cl.optimistic)
+	case path == "/eth/v1/beacon/states/head/finality_checkpoints":
+		fmt.Fprintf(w, `{"data":{"previous_justified":{"epoch":"0","root":"%v"},"current_justified":{"epoch":"1","root":"%v"},"finalized":{"epoch":"0","root":"%v"}}}`,
+			common.Hash{}, cl.justified, common.Hash{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// add makes the blocks available by their beacon root.
+func (cl *fakeCL) add(blocks ...*fakeBlock) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for _, block := range blocks {
+		cl.blocks[block.root.Hex()] = block
+	}
+}
+
+// set serves the block under the given specifier, e.g. "head".
+func (cl *fakeCL) set(specifier string, block *fakeBlock) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.blocks[specifier] = block
+}
+
+// takeFetched returns the specifiers fetched since the last call.
+func (cl *fakeCL) takeFetched() []string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	fetched := cl.fetched
+	cl.fetched = nil
+	return fetched
+}
+
+// newTestFetcher creates a fetcher for the fake CLs, without starting it.
+func newTestFetcher(t *testing.T, config Config, cls ...*fakeCL) *fetcher {
+	for i, cl := range cls {
+		config.ClClients = append(config.ClClients, CLConfig{Name: fmt.Sprintf("cl%d", i), Address: cl.URL, Priority: i})
+	}
+	config.BadBlockDir = t.TempDir()
+	f, err := NewFetcher(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// expectHeads checks the numbers of the blocks queued for delivery.
+func expectHeads(t *testing.T, f *fetcher, want ...uint64) {
+	t.Helper()
+	var have []uint64
+	for len(f.headCh) > 0 {
+		update := <-f.headCh
+		have = append(have, update.execData.Number)
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("delivered heads %v, want %v", have, want)
+	}
+}
+
+func TestFetcherBackfill(t *testing.T) {
+	var (
+		cl    = newFakeCL(t)
+		chain = makeFakeChain(nil, 12, 'a')
+		f     = newTestFetcher(t, Config{BackfillDepth: 3}, cl)
+	)
+	cl.add(chain...)
+	fetchHead := func(head *fakeBlock) {
+		t.Helper()
+		cl.set("head", head)
+		if err := f.fetchHead(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetchHead(chain[0])
+	expectHeads(t, f, 1)
+
+	// Missing ancestors are delivered oldest first, ahead of the head.
+	cl.takeFetched()
+	fetchHead(chain[3])
+	expectHeads(t, f, 2, 3, 4)
+	if have := cl.takeFetched(); len(have) != 3 {
+		t.Fatalf("fetched %v, want head and 2 ancestors", have)
+	}
+	// At most backfill_depth ancestors are fetched.
+	fetchHead(chain[9])
+	expectHeads(t, f, 7, 8, 9, 10)
+	if have := cl.takeFetched(); len(have) != 4 {
+		t.Fatalf("fetched %v, want head and 3 ancestors", have)
+	}
+	// A head dropped from the full queue is backfilled with the next one.
+	for len(f.headCh) < cap(f.headCh) {
+		f.headCh <- blockUpdate{}
+	}
+	fetchHead(chain[10])
+	for len(f.headCh) > 0 {
+		<-f.headCh
+	}
+	fetchHead(chain[11])
+	expectHeads(t, f, 11, 12)
+
+	// An ancestor which does not match the parent hash of its child is
+	// rejected.
+	var (
+		side  = makeFakeChain(chain[11], 2, 'b')
+		wrong = makeFakeChain(chain[11], 1, 'c')[0]
+	)
+	cl.add(side[1])
+	cl.set(side[0].root.Hex(), wrong)
+	cl.set("head", side[1])
+	update, err := f.headUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch, err := f.resolveBranch(update)
+	if !errors.Is(err, errUnverified) {
+		t.Fatalf("have %v, want %v", err, errUnverified)
+	}
+	if len(branch) != 0 || f.chain.get(wrong.data.BlockHash) != nil {
+		t.Fatal("mismatching ancestor accepted")
+	}
+}
+
+func TestFetcherStreamDown(t *testing.T) {
+	var (
+		cl    = newFakeCL(t)
+		chain = makeFakeChain(nil, 1, 'a')
+		f     = newTestFetcher(t, Config{}, cl)
+	)
+	cl.add(chain...)
+	cl.set("head", chain[0])
+	f.streaming.Store(true)
+	f.wg.Add(1)
+	go f.fetchLoop()
+	defer f.Stop()
+
+	waitFetch := func() {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if fetched := cl.takeFetched(); slices.Contains(fetched, "head") {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("head not fetched")
+			}
+		}
+	}
+	waitFetch()
+	// While streaming, the next poll is a minute away. A dropped stream
+	// triggers a fetch right away.
+	f.streaming.Store(false)
+	f.streamDown <- struct{}{}
+	waitFetch()
+}
+
+func TestFetcherFailover(t *testing.T) {
+	var (
+		preferred = newFakeCL(t)
+		fallback  = newFakeCL(t)
+		f         = newTestFetcher(t, Config{}, preferred, fallback)
+	)
+	expectSource := func(want string) {
+		t.Helper()
+		if have := f.ActiveSource(); have != want {
+			t.Fatalf("active source %s, want %s", have, want)
+		}
+	}
+	set := func(cl *fakeCL, health int, syncing, optimistic bool) {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		cl.health, cl.syncing, cl.optimistic = health, syncing, optimistic
+	}
+	for _, tt := range []struct {
+		name                string
+		health              int
+		syncing, optimistic bool
+	}{
+		{"erroring", http.StatusInternalServerError, false, false},
+		{"syncing", http.StatusPartialContent, false, false},
+		{"syncing", http.StatusOK, true, false},
+		{"optimistic", http.StatusOK, false, true},
+	} {
+		// Away from the unhealthy source, and back once it recovers.
+		set(preferred, tt.health, tt.syncing, tt.optimistic)
+		f.checkSources(false)
+		if f.ActiveSource() != "cl1" {
+			t.Fatalf("%s source kept", tt.name)
+		}
+		set(preferred, http.StatusOK, false, false)
+		f.checkSources(false)
+		expectSource("cl0")
+	}
+	// A failing sync status check is not mistaken for a synced node.
+	preferred.mu.Lock()
+	preferred.syncError = true
+	preferred.mu.Unlock()
+	f.checkSources(false)
+	expectSource("cl1")
+	preferred.mu.Lock()
+	preferred.syncError = false
+	preferred.mu.Unlock()
+	f.checkSources(false)
+	expectSource("cl0")
+
+	// A failed fetch switches away from a healthy source.
+	f.checkSources(true)
+	expectSource("cl1")
+	f.checkSources(false)
+	expectSource("cl0")
+
+	// So does a head which stopped advancing.
+	f.mu.Lock()
+	f.lastAdvance = time.Now().Add(-staleHeadTimeout - time.Second)
+	f.mu.Unlock()
+	f.checkSources(false)
+	expectSource("cl1")
+
+	// Without a healthy alternative, the active source is kept.
+	set(preferred, http.StatusServiceUnavailable, false, false)
+	f.checkSources(true)
+	expectSource("cl1")
+}
+
+// forkchoiceEL is a mock EL which reports the forkchoice updates it receives.
+type forkchoiceEL struct {
+	*mockEL
+	states chan engine.ForkchoiceStateV1
+}
+
+func (el *forkchoiceEL) ForkchoiceUpdated(version engine.PayloadVersion, update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	el.states <- update
+	return el.mockEL.ForkchoiceUpdated(version, update, payloadAttributes)
+}
+
+func TestFetcherSafeBlock(t *testing.T) {
+	var (
+		cl    = newFakeCL(t)
+		chain = makeFakeChain(nil, 3, 'a')
+		sink  = &forkchoiceEL{newMockEL("sink"), make(chan engine.ForkchoiceStateV1, 16)}
+		f     = newTestFetcher(t, Config{}, cl)
+	)
+	cl.add(chain...)
+	cl.set("finalized", chain[0])
+	cl.set("head", chain[2])
+	f.sink = sink
+	f.wg.Add(1)
+	go f.deliverLoop()
+	defer f.Stop()
+
+	expect := func(head, safe, final *fakeBlock) {
+		t.Helper()
+		want := engine.ForkchoiceStateV1{
+			HeadBlockHash:      head.data.BlockHash,
+			SafeBlockHash:      safe.data.BlockHash,
+			FinalizedBlockHash: final.data.BlockHash,
+		}
+		select {
+		case have := <-sink.states:
+			if have != want {
+				t.Fatalf("have forkchoice %+v, want %+v", have, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no forkchoice update")
+		}
+	}
+	// Without a justified checkpoint, the finalized block is the safe block.
+	if err := f.fetchFinal(); err != nil {
+		t.Fatal(err)
+	}
+	expect(chain[0], chain[0], chain[0])
+	if err := f.fetchSafe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.fetchHead(); err != nil {
+		t.Fatal(err)
+	}
+	expect(chain[2], chain[0], chain[0])
+
+	// The justified beacon root is resolved to its execution block hash.
+	cl.mu.Lock()
+	cl.justified = chain[1].root
+	cl.mu.Unlock()
+	if err := f.fetchSafe(); err != nil {
+		t.Fatal(err)
+	}
+	expect(chain[2], chain[1], chain[0])
 }
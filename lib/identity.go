@@ -0,0 +1,91 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// factorVersion identifies Factor to the ELs, in engine_getClientVersionV1.
+var factorVersion = engine.ClientVersionV1{
+	Code:    "FA",
+	Name:    "factor",
+	Version: "dev",
+	Commit:  "0x00000000",
+}
+
+// identify queries the client version of the EL via engine_getClientVersionV1,
+// and warns if it changed since the last query.
+func (r *remoteEL) identify() error {
+	var versions []engine.ClientVersionV1
+	if err := r.query(&versions, "engine_getClientVersionV1", factorVersion); err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return errors.New("no client version returned")
+	}
+	version := versions[0]
+	r.mu.Lock()
+	old := r.version
+	r.version = &version
+	r.mu.Unlock()
+
+	switch {
+	case old == nil:
+		log.Info("Identified EL client", "el", identity(r.name, &version))
+	case *old != version:
+		log.Warn("EL client version changed", "el", identity(r.name, old), "to", version.String())
+	}
+	return nil
+}
+
+// ClientVersion returns the client version of the EL, or nil if not known.
+func (r *remoteEL) ClientVersion() *engine.ClientVersionV1 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.version
+}
+
+// Identity describes the EL in logs and reports: its configured name, and its
+// client version if known.
+func (r *remoteEL) Identity() string {
+	return identity(r.name, r.ClientVersion())
+}
+
+// clientVersion returns the client version of the EL, if it reports one.
+func clientVersion(el ElApi) *engine.ClientVersionV1 {
+	if v, ok := el.(versionReporter); ok {
+		return v.ClientVersion()
+	}
+	return nil
+}
+
+// elIdentity describes the EL in logs: its configured name, and its client
+// version if known.
+func elIdentity(el ElApi) string {
+	return identity(el.Name(), clientVersion(el))
+}
+
+func identity(name string, version *engine.ClientVersionV1) string {
+	if version == nil {
+		return name
+	}
+	return name + "/" + version.String()
+}
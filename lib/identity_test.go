@@ -0,0 +1,86 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+)
+
+func TestClientVersion(t *testing.T) {
+	var (
+		version atomic.Value
+		down    atomic.Bool
+	)
+	version.Store("1.15.10")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var result interface{} = map[string]interface{}{"status": engine.VALID}
+		if req.Method == "engine_getClientVersionV1" {
+			result = []engine.ClientVersionV1{{Code: "GE", Name: "go-ethereum", Version: version.Load().(string), Commit: "0x36b2371c"}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}))
+	defer srv.Close()
+
+	el, err := newRemoteEL(ELConfig{Name: "el", Address: srv.URL, BreakerThreshold: 1, BreakerCooldown: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close()
+	waitFor(t, "client version", func() bool { return el.ClientVersion() != nil })
+	if have, want := el.Identity(), "el/GE-go-ethereum-1.15.10-0x36b2371c"; have != want {
+		t.Fatalf("have identity %s, want %s", have, want)
+	}
+	// The answers in divergence reports carry the client version.
+	if a := newAnswer(el, engine.PayloadStatusV1{}, nil); a.Client == nil || a.Client.Version != "1.15.10" {
+		t.Fatalf("wrong client in answer: %+v", a.Client)
+	}
+	// The version is queried again once the EL recovers from an outage.
+	down.Store(true)
+	el.NewPayload(engine.PayloadV3, engine.ExecutableData{}, nil, nil, nil)
+	if el.Healthy() {
+		t.Fatal("breaker not opened")
+	}
+	version.Store("1.15.11")
+	down.Store(false)
+	el.breaker.now = func() time.Time { return time.Now().Add(time.Second) }
+	el.NewPayload(engine.PayloadV3, engine.ExecutableData{}, nil, nil, nil)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if v := el.ClientVersion(); v != nil && v.Version == "1.15.11" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client version not refreshed: %v", el.ClientVersion())
+		}
+	}
+}
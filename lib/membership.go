@@ -0,0 +1,183 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// AddEL connects to a new EL, and starts relaying to it. The EL is brought up
+// to date with the latest head right away. If it is configured as primary, it
+// becomes the preferred primary.
+func (r *relayPI) AddEL(conf ELConfig) error {
+	el, err := newRemoteEL(conf, r.breakerEvents)
+	if err != nil {
+		return err
+	}
+	if err := r.install(el, conf.Primary, conf.Builder, false); err != nil {
+		el.Close()
+		return err
+	}
+	log.Info("Added EL", "el", el.Identity())
+	return nil
+}
+
+// ReplaceEL replaces the EL of the same name with a new connection, e.g. to
+// change its address or credentials. The EL keeps its place in the order of
+// preference, unless it is configured as primary.
+func (r *relayPI) ReplaceEL(conf ELConfig) error {
+	el, err := newRemoteEL(conf, r.breakerEvents)
+	if err != nil {
+		return err
+	}
+	if err := r.install(el, conf.Primary, conf.Builder, true); err != nil {
+		el.Close()
+		return err
+	}
+	log.Info("Replaced EL", "el", el.Identity())
+	return nil
+}
+
+// RemoveEL stops relaying to the EL with the given name. The last EL can't be
+// removed.
+func (r *relayPI) RemoveEL(name string) error {
+	r.mu.Lock()
+	i := r.indexOf(name)
+	if i < 0 {
+		r.mu.Unlock()
+		return fmt.Errorf("unknown EL %q", name)
+	}
+	if len(r.els) == 1 {
+		r.mu.Unlock()
+		return errors.New("can't remove the last EL")
+	}
+	old := r.workers[i]
+	if r.builder == old.el {
+		r.builder = nil
+	}
+	r.setELs(slices.Delete(slices.Clone(r.els), i, i+1), slices.Delete(slices.Clone(r.workers), i, i+1))
+	r.mu.Unlock()
+
+	old.close()
+	old.metrics.unregister()
+	closeEL(old.el)
+	log.Info("Removed EL", "el", elIdentity(old.el))
+	return nil
+}
+
+// install adds the EL, or replaces the EL of the same name.
+func (r *relayPI) install(el ElApi, primary, builder, replace bool) error {
+	w := newELWorker(el)
+	r.mu.Lock()
+	i := r.indexOf(el.Name())
+	switch {
+	case replace && i < 0:
+		r.mu.Unlock()
+		w.close()
+		return fmt.Errorf("unknown EL %q", el.Name())
+	case !replace && i >= 0:
+		r.mu.Unlock()
+		w.close()
+		return fmt.Errorf("EL %q already exists", el.Name())
+	}
+	// The latest head is queued while holding the lock, so that no newer
+	// update can be dispatched to the worker before it.
+	r.bootstrap(w)
+
+	var (
+		els     = slices.Clone(r.els)
+		workers = slices.Clone(r.workers)
+		old     *elWorker
+	)
+	if replace {
+		old = workers[i]
+		els, workers = slices.Delete(els, i, i+1), slices.Delete(workers, i, i+1)
+		if r.builder == old.el {
+			r.builder = nil
+		}
+	} else {
+		i = len(els)
+	}
+	if primary {
+		i = 0
+	}
+	if builder {
+		r.builder = el
+	}
+	r.setELs(slices.Insert(els, i, el), slices.Insert(workers, i, w))
+	r.mu.Unlock()
+
+	if old != nil {
+		old.close()
+		closeEL(old.el)
+	}
+	return nil
+}
+
+// indexOf returns the index of the EL with the given name, or -1. The lock must
+// be held.
+func (r *relayPI) indexOf(name string) int {
+	return slices.IndexFunc(r.els, func(el ElApi) bool { return el.Name() == name })
+}
+
+// setELs replaces the ELs, keeping the current primary if it is still present.
+// The lock must be held.
+func (r *relayPI) setELs(els []ElApi, workers []*elWorker) {
+	current := r.els[r.primary]
+	r.els, r.workers, r.primary = els, workers, 0
+	if i := slices.Index(els, current); i >= 0 {
+		r.primary = i
+	}
+}
+
+// bootstrap queues the latest head payload and forkchoice update for a new
+// EL. If the EL is missing the ancestors of the head, they are replayed by a
+// catch-up. The lock must be held.
+func (r *relayPI) bootstrap(w *elWorker) {
+	fcu := r.lastForkchoice
+	if fcu == nil {
+		return
+	}
+	if head, ok := r.payloads.Peek(fcu.state.HeadBlockHash); ok {
+		w.push(&elTask{
+			method: fmt.Sprintf("NPV%d", head.version),
+			call: func(el ElApi) (engine.PayloadStatusV1, error) {
+				return r.sendPayload(el, head)
+			},
+		})
+	}
+	w.push(&elTask{
+		method:     fmt.Sprintf("FCUV%d", fcu.version),
+		forkchoice: true,
+		call: func(el ElApi) (engine.PayloadStatusV1, error) {
+			res, err := el.ForkchoiceUpdated(fcu.version, fcu.state, nil)
+			return res.PayloadStatus, err
+		},
+	})
+}
+
+// closeEL closes the connection to the EL, if it has one.
+func closeEL(el ElApi) {
+	if c, ok := el.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
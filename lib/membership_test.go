@@ -0,0 +1,107 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestRelayMembership(t *testing.T) {
+	var (
+		a, b  = newMockEL("a"), newMockEL("b")
+		relay = newRelay([]ElApi{a})
+	)
+	defer relay.Close()
+	deliver := func(number byte) {
+		payload := engine.ExecutableData{Number: uint64(number), BlockHash: common.Hash{number}}
+		relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+		relay.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{HeadBlockHash: payload.BlockHash}, nil)
+	}
+	names := func() (names []string) {
+		els, _ := relay.snapshot()
+		for _, el := range els {
+			names = append(names, el.Name())
+		}
+		return names
+	}
+	methods := func(el *mockEL) []string {
+		el.mu.Lock()
+		defer el.mu.Unlock()
+		return el.methods
+	}
+	deliver(1)
+
+	// A new EL gets the latest head right away, then the following updates.
+	if err := relay.install(b, false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	b.waitCalls(t, 2)
+	deliver(2)
+	b.waitCalls(t, 4)
+	want := []string{"NP 1", "FCU " + common.Hash{1}.TerminalString(), "NP 2", "FCU " + common.Hash{2}.TerminalString()}
+	if have := methods(b); !reflect.DeepEqual(have, want) {
+		t.Fatalf("have calls %v, want %v", have, want)
+	}
+	if err := relay.install(newMockEL("b"), false, false, false); err == nil {
+		t.Fatal("duplicate EL added")
+	}
+
+	// A replacement takes the place of the old EL, which gets no more calls.
+	b2 := newMockEL("b")
+	if err := relay.install(b2, false, true, true); err != nil {
+		t.Fatal(err)
+	}
+	b2.waitCalls(t, 2)
+	deliver(3)
+	b2.waitCalls(t, 4)
+	b.waitCalls(t, 4)
+	if relay.builder != b2 {
+		t.Fatal("replacement not made builder")
+	}
+
+	// Removing the primary promotes the next EL.
+	if err := relay.RemoveEL("a"); err != nil {
+		t.Fatal(err)
+	}
+	if have := relay.Primary(); have != "b" {
+		t.Fatalf("have primary %s, want b", have)
+	}
+	deliver(4)
+	a.waitCalls(t, 6)
+	if err := relay.RemoveEL("b"); err == nil {
+		t.Fatal("last EL removed")
+	}
+	if err := relay.RemoveEL("x"); err == nil {
+		t.Fatal("unknown EL removed")
+	}
+
+	// An EL added as primary goes first.
+	if err := relay.install(newMockEL("c"), true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := names(), []string{"c", "b"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have order %v, want %v", have, want)
+	}
+	deliver(5)
+	if have := relay.Primary(); have != "c" {
+		t.Fatalf("have primary %s, want c", have)
+	}
+}
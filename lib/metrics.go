@@ -0,0 +1,179 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	headGauge      = metrics.NewRegisteredGauge("factor/chain/head", nil)
+	finalizedGauge = metrics.NewRegisteredGauge("factor/chain/finalized", nil)
+
+	// Updates dropped because the relay did not keep up with the CL.
+	droppedHeadMeter      = metrics.NewRegisteredCounter("factor/cl/dropped/head", nil)
+	droppedSafeMeter      = metrics.NewRegisteredCounter("factor/cl/dropped/safe", nil)
+	droppedFinalizedMeter = metrics.NewRegisteredCounter("factor/cl/dropped/finalized", nil)
+
+	fetchFailureMeter = metrics.NewRegisteredCounter("factor/cl/fetch/failures", nil)
+)
+
+// metricName turns a configured name into a metric name component, which
+// Prometheus restricts to letters, digits and underscores.
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// newLatencyHistogram registers a histogram of call latencies in milliseconds,
+// sampled with an exponentially decaying reservoir. The Prometheus exporter
+// publishes it as a summary with a count and quantiles.
+func newLatencyHistogram(name string) metrics.Histogram {
+	return metrics.GetOrRegisterHistogram(name, nil, metrics.NewExpDecaySample(1028, 0.015))
+}
+
+// clMetrics are the metrics of the requests to a CL source.
+type clMetrics struct {
+	requests metrics.Histogram // request latency, in milliseconds
+	failures *metrics.Counter
+}
+
+func newCLMetrics(name string) clMetrics {
+	prefix := "factor/cl/" + metricName(name) + "/"
+	return clMetrics{
+		requests: newLatencyHistogram(prefix + "requests"),
+		failures: metrics.GetOrRegisterCounter(prefix+"failures", nil),
+	}
+}
+
+// elMetrics are the metrics of the calls to an EL. They are named after the
+// configured EL name, so that the series survive client upgrades.
+type elMetrics struct {
+	prefix     string
+	newPayload metrics.Histogram // call latency, in milliseconds
+	forkchoice metrics.Histogram // call latency, in milliseconds
+	queue      *metrics.Gauge
+	dropped    *metrics.Counter
+	client     *metrics.GaugeInfo
+	version    *engine.ClientVersionV1 // last exported client version
+}
+
+func newELMetrics(name string) *elMetrics {
+	prefix := "factor/el/" + metricName(name) + "/"
+	return &elMetrics{
+		prefix:     prefix,
+		newPayload: newLatencyHistogram(prefix + "newpayload"),
+		forkchoice: newLatencyHistogram(prefix + "forkchoice"),
+		queue:      metrics.GetOrRegisterGauge(prefix+"queue", nil),
+		dropped:    metrics.GetOrRegisterCounter(prefix+"dropped", nil),
+		client:     metrics.GetOrRegisterGaugeInfo(prefix+"client", nil),
+	}
+}
+
+// record updates the metrics with the outcome of a call.
+func (m *elMetrics) record(task *elTask, status engine.PayloadStatusV1, err error, elapsed time.Duration) {
+	switch {
+	case task.forkchoice:
+		m.forkchoice.Update(elapsed.Milliseconds())
+	case strings.HasPrefix(task.method, "NP"):
+		m.newPayload.Update(elapsed.Milliseconds())
+	}
+	if err != nil {
+		metrics.GetOrRegisterCounter(m.prefix+"errors/"+errorClass(err), nil).Inc(1)
+		return
+	}
+	if status.Status != "" {
+		metrics.GetOrRegisterCounter(m.prefix+"status/"+metricName(strings.ToLower(status.Status)), nil).Inc(1)
+	}
+}
+
+// setClient exports the client version of the EL, if it changed.
+func (m *elMetrics) setClient(v *engine.ClientVersionV1) {
+	if v == nil || v == m.version {
+		return
+	}
+	m.version = v
+	m.client.Update(metrics.GaugeInfoValue{
+		"code":    v.Code,
+		"name":    v.Name,
+		"version": v.Version,
+		"commit":  v.Commit,
+	})
+}
+
+// unregister removes the metrics of the EL.
+func (m *elMetrics) unregister() {
+	var names []string
+	metrics.DefaultRegistry.Each(func(name string, _ interface{}) {
+		if strings.HasPrefix(name, m.prefix) {
+			names = append(names, name)
+		}
+	})
+	for _, name := range names {
+		metrics.DefaultRegistry.Unregister(name)
+	}
+}
+
+// errorClass classifies a failed call for the error counters.
+func errorClass(err error) string {
+	var (
+		rpcErr rpc.Error
+		netErr net.Error
+	)
+	switch {
+	case errors.Is(err, errBreakerOpen):
+		return "breaker"
+	case errors.Is(err, errUnsupported):
+		return "unsupported"
+	case errors.Is(err, errCatchUpFailed):
+		return "catchup"
+	case errors.As(err, &rpcErr):
+		return "response"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "transport"
+	}
+}
+
+// metricsServer serves the metrics for Prometheus to scrape.
+type metricsServer struct {
+	*httpServer
+}
+
+// NewMetricsServer creates the metrics server, and enables the collection of
+// metrics.
+func NewMetricsServer(config MetricsConfig) *metricsServer {
+	metrics.Enable()
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", prometheus.Handler(metrics.DefaultRegistry))
+	return &metricsServer{newHTTPServer("metrics", config.Listen, mux)}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestMetrics(t *testing.T) {
+	var (
+		good  = newMockEL("metrics-good")
+		bad   = newMockEL("metrics-bad")
+		relay = newRelay([]ElApi{good, bad})
+		srv   = NewMetricsServer(MetricsConfig{})
+	)
+	defer relay.Close()
+	relay.divergenceDir = t.TempDir()
+	bad.status = engine.INVALID
+
+	// The metrics live in the default registry, drop them for the next run.
+	_, workers := relay.snapshot()
+	t.Cleanup(func() {
+		for _, w := range workers {
+			w.metrics.unregister()
+		}
+	})
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		srv.http.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	payload := engine.ExecutableData{Number: 1, BlockHash: common.Hash{1}}
+	relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+	relay.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{HeadBlockHash: payload.BlockHash}, nil)
+
+	want := []string{
+		"factor_el_metrics_good_newpayload_count 1",
+		"factor_el_metrics_good_forkchoice_count 1",
+		"factor_el_metrics_good_status_valid 2",
+		"factor_el_metrics_bad_newpayload_count 1",
+		"factor_el_metrics_bad_status_invalid 2",
+		"factor_el_metrics_bad_queue 0",
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		out, missing := scrape(), ""
+		for _, line := range want {
+			if !strings.Contains(out, line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %q in:\n%s", missing, out)
+		}
+	}
+	// The metrics of removed ELs go away.
+	if err := relay.RemoveEL("metrics-bad"); err != nil {
+		t.Fatal(err)
+	}
+	if out := scrape(); strings.Contains(out, "factor_el_metrics_bad_") {
+		t.Fatalf("metrics of removed EL still exported:\n%s", out)
+	}
+}
@@ -18,90 +18,354 @@ package lib
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/beacon/engine"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/lru"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
-	"sync"
 )
 
 type relayPI struct {
-	els []ElApi
+	tracker       *divergenceTracker
+	divergenceDir string // directory where divergence reports are written
+	divergences   event.Feed
+	breakerEvents *event.Feed // state changes of the EL circuit breakers
+
+	// The ELs can be changed at runtime. The slices are replaced rather than
+	// modified, so that calls in flight can keep using them.
+	mu             sync.Mutex
+	els            []ElApi                                 // in order of preference, the configured primary first
+	workers        []*elWorker                             // delivery queue of each EL
+	builder        ElApi                                   // EL which builds payloads, the primary if nil
+	primary        int                                     // index of the EL whose responses are returned
+	payloads       lru.BasicLRU[common.Hash, *payloadCall] // recently relayed payloads
+	builds         lru.BasicLRU[engine.PayloadID, ElApi]   // EL building each requested payload
+	lastForkchoice *forkchoiceCall                         // last relayed forkchoice update
 }
 
+// buildCacheSize is the number of payload ids tracked, to route getPayload
+// calls to the EL building the payload.
+const buildCacheSize = 32
+
 func (r *relayPI) Name() string {
 	return "relayer"
 }
 
-func NewRelayPI(config []ELConfig) (*relayPI, error) {
-	var els []ElApi
-	for _, conf := range config {
-		el, err := newRemoteEL(conf.Address, conf.Name, conf.JwtSecret, conf.Headers)
+func NewRelayPI(cfg Config) (*relayPI, error) {
+	config := cfg.ElClients
+	if len(config) == 0 {
+		return nil, errors.New("no EL client configured")
+	}
+	var (
+		els           []ElApi
+		primary       = -1
+		builder       ElApi
+		breakerEvents = new(event.Feed)
+	)
+	for i, conf := range config {
+		if conf.Primary {
+			if primary >= 0 {
+				return nil, fmt.Errorf("multiple primary ELs: %s and %s", config[primary].Name, conf.Name)
+			}
+			primary = i
+		}
+		el, err := newRemoteEL(conf, breakerEvents)
 		if err != nil {
 			return nil, err
 		}
+		if conf.Builder {
+			if builder != nil {
+				return nil, fmt.Errorf("multiple builder ELs: %s and %s", builder.Name(), conf.Name)
+			}
+			builder = el
+		}
 		els = append(els, el)
 	}
-	return &relayPI{els: els}, nil
+	if primary > 0 {
+		// Move the primary to the front, keeping the order of the fallbacks.
+		el := els[primary]
+		copy(els[1:primary+1], els[:primary])
+		els[0] = el
+	}
+	r := newRelay(els)
+	r.breakerEvents = breakerEvents
+	if builder != nil {
+		log.Info("Using builder EL", "name", elIdentity(builder))
+		r.builder = builder
+	}
+	if cfg.DivergenceDir != "" {
+		r.divergenceDir = cfg.DivergenceDir
+	}
+	return r, nil
 }
 
-func (r *relayPI) ForkchoiceUpdatedV1(update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	for _, el := range r.els[1:] {
-		wg.Add(1)
-		go func(el ElApi) {
-			defer wg.Done()
-			if _, err := el.ForkchoiceUpdatedV1(update, payloadAttributes); err != nil {
-				log.Info("Remote call error", "method", "FCUV1", "el", el.Name(), "err", err)
-			}
-		}(el)
+func newRelay(els []ElApi) *relayPI {
+	log.Info("Using primary EL", "name", elIdentity(els[0]))
+	r := &relayPI{
+		els:           els,
+		divergenceDir: defaultDivergenceDir,
+		breakerEvents: new(event.Feed),
+		payloads:      lru.NewBasicLRU[common.Hash, *payloadCall](payloadCacheSize),
+		builds:        lru.NewBasicLRU[engine.PayloadID, ElApi](buildCacheSize),
 	}
-	a, err := r.els[0].ForkchoiceUpdatedV1(update, payloadAttributes)
-	if err != nil {
-		log.Info("Remote call error", "method", "FCUV1", "el", r.els[0].Name(), "err", err)
+	r.tracker = newDivergenceTracker(func(d *divergence) {
+		d.report(r.divergenceDir)
+		r.divergences.Send(d)
+	})
+	for _, el := range els {
+		r.workers = append(r.workers, newELWorker(el))
 	}
-	return a, err
+	return r
 }
 
-func (r *relayPI) NewPayloadV3(params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash) (engine.PayloadStatusV1, error) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	for _, el := range r.els[1:] {
-		wg.Add(1)
-		go func(el ElApi) {
-			defer wg.Done()
-			if _, err := el.NewPayloadV3(params, versionedHashes, beaconRoot); err != nil {
-				log.Info("Remote call error", "method", "NPV3", "el", el.Name(), "err", err)
-			}
-		}(el)
+// Close stops the delivery to the ELs.
+func (r *relayPI) Close() {
+	_, workers := r.snapshot()
+	for _, w := range workers {
+		w.close()
+		closeEL(w.el)
 	}
-	a, err := r.els[0].NewPayloadV3(params, versionedHashes, beaconRoot)
-	if err != nil {
-		log.Info("Remote call error", "method", "NPV3", "el", r.els[0].Name(), "err", err)
+}
+
+// SubscribeDivergences subscribes to the divergences between the ELs.
+func (r *relayPI) SubscribeDivergences(ch chan<- *divergence) event.Subscription {
+	return r.divergences.Subscribe(ch)
+}
+
+// SubscribeBreakerEvents subscribes to the state changes of the EL circuit
+// breakers.
+func (r *relayPI) SubscribeBreakerEvents(ch chan<- breakerEvent) event.Subscription {
+	return r.breakerEvents.Subscribe(ch)
+}
+
+// Primary returns the name of the EL currently used as primary.
+func (r *relayPI) Primary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.els[r.primary].Name()
+}
+
+// ClientVersion returns the client version of the primary EL, or nil if not
+// known.
+func (r *relayPI) ClientVersion() *engine.ClientVersionV1 {
+	r.mu.Lock()
+	el := r.els[r.primary]
+	r.mu.Unlock()
+	return clientVersion(el)
+}
+
+// snapshot returns the current ELs and their workers.
+func (r *relayPI) snapshot() ([]ElApi, []*elWorker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.els, r.workers
+}
+
+// workerOf returns the worker of the EL, or nil if it has been removed.
+func (r *relayPI) workerOf(el ElApi) *elWorker {
+	_, workers := r.snapshot()
+	for _, w := range workers {
+		if w.el == el {
+			return w
+		}
 	}
-	return a, err
+	return nil
 }
 
-func (r *relayPI) ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	for _, el := range r.els[1:] {
-		wg.Add(1)
-		go func(el ElApi) {
-			defer wg.Done()
-			if _, err := el.ExchangeTransitionConfigurationV1(config); err != nil {
-				log.Info("Remote call error", "method", "ETCV1", "el", el.Name(), "err", err)
-			}
-		}(el)
+// selectPrimary picks the most preferred healthy EL as primary, and returns
+// it. ELs which are paused or catching up are passed over, so that waiting
+// for their answer does not hold up the others. If no EL is available, the
+// configured primary is used.
+func (r *relayPI) selectPrimary() ElApi {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := 0
+	for i, el := range r.els {
+		if isHealthy(el) && !r.workers[i].isPaused() && !r.workers[i].catchingUp.Load() {
+			next = i
+			break
+		}
 	}
-	a, err := r.els[0].ExchangeTransitionConfigurationV1(config)
-	if err != nil {
-		log.Info("Remote call error", "method", "ETCV1", "el", r.els[0].Name(), "err", err)
+	if next != r.primary {
+		if next > r.primary {
+			log.Warn("Primary EL unavailable, promoting fallback", "from", elIdentity(r.els[r.primary]), "to", elIdentity(r.els[next]))
+		} else {
+			log.Info("Restoring preferred primary EL", "from", elIdentity(r.els[r.primary]), "to", elIdentity(r.els[next]))
+		}
+		r.primary = next
 	}
-	return a, err
+	return r.els[next]
 }
 
-func (r *relayPI) GetPayloadV1(payloadID engine.PayloadID) (*engine.ExecutableData, error) {
-	return nil, errors.New("GetPayloadV1 not supported")
+// selectBuilder returns the EL which builds payloads: the designated builder
+// if it is healthy, the primary otherwise.
+func (r *relayPI) selectBuilder(primary ElApi) ElApi {
+	r.mu.Lock()
+	builder := r.builder
+	r.mu.Unlock()
+
+	if builder == nil {
+		return primary
+	}
+	if w := r.workerOf(builder); w == nil || w.isPaused() || !isHealthy(builder) {
+		log.Warn("Builder EL unhealthy, building on primary", "builder", elIdentity(builder), "primary", elIdentity(primary))
+		return primary
+	}
+	return builder
+}
+
+// dispatch queues the call for all ELs, and waits until the primary has
+// answered. The other ELs are served by their own workers, so a slow client
+// does not hold up the rest. If tracked, the answers of all ELs are checked for
+// divergence once they are in.
+func (r *relayPI) dispatch(method string, forkchoice bool, track *trackedCallInfo, call func(el ElApi, primary bool) (engine.PayloadStatusV1, error)) {
+	r.dispatchTo(r.selectPrimary(), method, forkchoice, track, call)
+}
+
+// dispatchTo is like dispatch, but waits for the given EL, whose answer is
+// returned instead of the primary's. If the EL has been removed meanwhile, the
+// most preferred one is waited for.
+func (r *relayPI) dispatchTo(respondent ElApi, method string, forkchoice bool, track *trackedCallInfo, call func(el ElApi, primary bool) (engine.PayloadStatusV1, error)) {
+	els, workers := r.snapshot()
+	var primary int
+	for i, el := range els {
+		if el == respondent {
+			primary = i
+		}
+	}
+	var record func(int, elAnswer)
+	if track != nil {
+		names := make([]string, len(els))
+		for i, el := range els {
+			names[i] = el.Name()
+		}
+		record = r.tracker.track(method, track.number, track.hash, track.payload, names)
+	}
+	done := make(chan struct{})
+	for i, w := range workers {
+		task := &elTask{
+			method:     method,
+			forkchoice: forkchoice,
+			call: func(el ElApi) (engine.PayloadStatusV1, error) {
+				return call(el, i == primary)
+			},
+		}
+		if track != nil {
+			task.block = &blockRef{Number: track.number, Hash: track.hash}
+		}
+		if record != nil {
+			task.record = func(a elAnswer) { record(i, a) }
+		}
+		if i == primary {
+			task.done = done
+		}
+		w.push(task)
+	}
+	<-done
+}
+
+// trackedCallInfo identifies a call whose answers are checked for divergence.
+type trackedCallInfo struct {
+	number  uint64
+	hash    common.Hash
+	payload interface{}
+}
+
+func (r *relayPI) ForkchoiceUpdated(version engine.PayloadVersion, update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	var (
+		method = fmt.Sprintf("FCUV%d", version)
+		resp   engine.ForkChoiceResponse
+		err    = errStopped // unless the primary is called
+	)
+	var number uint64
+	r.mu.Lock()
+	if call, ok := r.payloads.Peek(update.HeadBlockHash); ok {
+		number = call.params.Number
+	}
+	r.lastForkchoice = &forkchoiceCall{version, update}
+	r.mu.Unlock()
+	track := &trackedCallInfo{number, update.HeadBlockHash, struct {
+		ForkchoiceState   engine.ForkchoiceStateV1  `json:"forkchoiceState"`
+		PayloadAttributes *engine.PayloadAttributes `json:"payloadAttributes"`
+	}{update, payloadAttributes}}
+	// Payloads are only built by one EL, and its answer is returned, so that
+	// the payload id can be fetched from it later.
+	respondent := r.selectPrimary()
+	if payloadAttributes != nil {
+		respondent = r.selectBuilder(respondent)
+	}
+	r.dispatchTo(respondent, method, true, track, func(el ElApi, respond bool) (engine.PayloadStatusV1, error) {
+		attrs := payloadAttributes
+		if !respond {
+			attrs = nil
+		}
+		res, callErr := el.ForkchoiceUpdated(version, update, attrs)
+		if respond {
+			resp, err = res, callErr
+			if callErr == nil && res.PayloadID != nil {
+				r.mu.Lock()
+				r.builds.Add(*res.PayloadID, el)
+				r.mu.Unlock()
+			}
+		}
+		return res.PayloadStatus, callErr
+	})
+	return resp, err
+}
+
+func (r *relayPI) NewPayload(version engine.PayloadVersion, params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash, executionRequests [][]byte) (engine.PayloadStatusV1, error) {
+	var (
+		method = fmt.Sprintf("NPV%d", version)
+		resp   engine.PayloadStatusV1
+		err    = errStopped // unless the primary is called
+	)
+	call := &payloadCall{version, params, versionedHashes, beaconRoot, executionRequests}
+	r.mu.Lock()
+	r.payloads.Add(params.BlockHash, call)
+	r.mu.Unlock()
+	track := &trackedCallInfo{params.Number, params.BlockHash, struct {
+		ExecutionPayload  engine.ExecutableData `json:"executionPayload"`
+		VersionedHashes   []common.Hash         `json:"versionedHashes"`
+		BeaconRoot        *common.Hash          `json:"parentBeaconBlockRoot"`
+		ExecutionRequests []hexutil.Bytes       `json:"executionRequests"`
+	}{params, versionedHashes, beaconRoot, toHexBytes(executionRequests)}}
+	r.dispatch(method, false, track, func(el ElApi, primary bool) (engine.PayloadStatusV1, error) {
+		res, callErr := r.sendPayload(el, call)
+		if primary {
+			resp, err = res, callErr
+		}
+		return res, callErr
+	})
+	return resp, err
+}
+
+func (r *relayPI) ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error) {
+	var (
+		resp *engine.TransitionConfigurationV1
+		err  = errStopped // unless the primary is called
+	)
+	r.dispatch("ETCV1", false, nil, func(el ElApi, primary bool) (engine.PayloadStatusV1, error) {
+		res, callErr := el.ExchangeTransitionConfigurationV1(config)
+		if primary {
+			resp, err = res, callErr
+		}
+		return engine.PayloadStatusV1{}, callErr
+	})
+	return resp, err
+}
+
+// GetPayload fetches the payload from the EL which was asked to build it.
+func (r *relayPI) GetPayload(version engine.PayloadVersion, payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error) {
+	r.mu.Lock()
+	el, ok := r.builds.Get(payloadID)
+	r.mu.Unlock()
+	if !ok {
+		return nil, engine.UnknownPayload
+	}
+	return el.GetPayload(version, payloadID)
 }
@@ -0,0 +1,308 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// mockEL is an ElApi which answers every call with a fixed status.
+type mockEL struct {
+	name        string
+	status      string
+	latestValid *common.Hash
+	healthy     bool
+	gate        chan struct{} // if set, calls block until it yields
+
+	mu      sync.Mutex
+	calls   int
+	methods []string
+}
+
+func newMockEL(name string) *mockEL {
+	return &mockEL{name: name, status: engine.VALID, healthy: true}
+}
+
+func (m *mockEL) ForkchoiceUpdated(version engine.PayloadVersion, update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	m.wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	m.methods = append(m.methods, "FCU "+update.HeadBlockHash.TerminalString())
+	resp := engine.ForkChoiceResponse{PayloadStatus: engine.PayloadStatusV1{Status: m.status, LatestValidHash: m.latestValid}}
+	if payloadAttributes != nil {
+		m.methods = append(m.methods, "build")
+		id := m.payloadID()
+		resp.PayloadID = &id
+	}
+	return resp, nil
+}
+
+// payloadID returns the id of the payloads built by the EL.
+func (m *mockEL) payloadID() engine.PayloadID {
+	var id engine.PayloadID
+	copy(id[:], m.name)
+	return id
+}
+
+func (m *mockEL) ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error) {
+	return nil, errors.New("not supported")
+}
+
+func (m *mockEL) GetPayload(version engine.PayloadVersion, payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error) {
+	if payloadID != m.payloadID() {
+		return nil, engine.UnknownPayload
+	}
+	return &engine.ExecutionPayloadEnvelope{ExecutionPayload: &engine.ExecutableData{ExtraData: []byte(m.name)}}, nil
+}
+
+func (m *mockEL) NewPayload(version engine.PayloadVersion, params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash, executionRequests [][]byte) (engine.PayloadStatusV1, error) {
+	m.wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	m.methods = append(m.methods, fmt.Sprintf("NP %d", params.Number))
+	return engine.PayloadStatusV1{Status: m.status, LatestValidHash: m.latestValid}, nil
+}
+
+func (m *mockEL) Name() string { return m.name }
+
+func (m *mockEL) wait() {
+	if m.gate != nil {
+		<-m.gate
+	}
+}
+
+// waitCalls waits until the EL has been called n times.
+func (m *mockEL) waitCalls(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		m.mu.Lock()
+		calls := m.calls
+		m.mu.Unlock()
+		if calls == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("EL %s: have %d calls, want %d", m.name, calls, n)
+		}
+	}
+}
+
+func (m *mockEL) Healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy
+}
+
+func (m *mockEL) setHealthy(healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.healthy = healthy
+}
+
+func TestRelayPrimaryFailover(t *testing.T) {
+	var (
+		a, b, c = newMockEL("a"), newMockEL("b"), newMockEL("c")
+		relay   = newRelay([]ElApi{a, b, c})
+	)
+	defer relay.Close()
+	a.status, b.status, c.status = engine.VALID, engine.SYNCING, engine.ACCEPTED
+	// The parent is unknown, so the ELs which are not VALID can't be caught up.
+	payload := engine.ExecutableData{BlockHash: common.Hash{1}, ParentHash: common.Hash{2}}
+	check := func(wantPrimary, wantStatus string) {
+		t.Helper()
+		res, err := relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != wantStatus {
+			t.Fatalf("have status %s, want %s", res.Status, wantStatus)
+		}
+		if have := relay.Primary(); have != wantPrimary {
+			t.Fatalf("have primary %s, want %s", have, wantPrimary)
+		}
+	}
+	check("a", engine.VALID)
+	a.setHealthy(false)
+	check("b", engine.SYNCING)
+	b.setHealthy(false)
+	check("c", engine.ACCEPTED)
+	a.setHealthy(true)
+	check("a", engine.VALID)
+	// With no healthy EL, the configured primary is used.
+	a.setHealthy(false)
+	c.setHealthy(false)
+	check("a", engine.VALID)
+
+	for _, el := range []*mockEL{a, b, c} {
+		el.waitCalls(t, 5)
+	}
+}
+
+func TestNewRelayPrimary(t *testing.T) {
+	config := []ELConfig{
+		{Name: "a", Address: "http://localhost:8551"},
+		{Name: "b", Address: "http://localhost:8552"},
+		{Name: "c", Address: "http://localhost:8553", Primary: true},
+	}
+	relay, err := NewRelayPI(Config{ElClients: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, el := range relay.els {
+		names = append(names, el.Name())
+	}
+	if have, want := names, []string{"c", "a", "b"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have order %v, want %v", have, want)
+	}
+	config[0].Primary = true
+	if _, err := NewRelayPI(Config{ElClients: config}); err == nil {
+		t.Fatal("expected error for multiple primaries")
+	}
+}
+
+func TestDiverges(t *testing.T) {
+	var (
+		h1, h2 = common.Hash{1}, common.Hash{2}
+		valid  = elAnswer{Status: engine.VALID, LatestValidHash: &h1}
+	)
+	for i, tt := range []struct {
+		answers []elAnswer
+		want    bool
+	}{
+		{[]elAnswer{valid, valid}, false},
+		{[]elAnswer{valid, {Status: engine.INVALID, LatestValidHash: &h2}}, true},
+		{[]elAnswer{valid, {Status: engine.VALID, LatestValidHash: &h2}}, true},
+		{[]elAnswer{valid, {Status: engine.VALID}}, false},
+		{[]elAnswer{valid, {Status: engine.SYNCING}, {Error: "timeout"}}, false},
+		{[]elAnswer{{Status: engine.INVALID}, {Status: engine.ACCEPTED}}, false},
+	} {
+		if have := diverges(tt.answers); have != tt.want {
+			t.Errorf("test %d: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+func TestRelayDivergence(t *testing.T) {
+	var (
+		a, b, c = newMockEL("a"), newMockEL("b"), newMockEL("c")
+		relay   = newRelay([]ElApi{a, b, c})
+		ch      = make(chan *divergence, 1)
+		parent  = common.Hash{1}
+	)
+	defer relay.Close()
+	relay.divergenceDir = t.TempDir()
+	sub := relay.SubscribeDivergences(ch)
+	defer sub.Unsubscribe()
+
+	b.status, b.latestValid = engine.INVALID, &parent
+	c.status = engine.SYNCING
+	payload := engine.ExecutableData{Number: 10, BlockHash: common.Hash{2}, ParentHash: parent}
+	if res, err := relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil); err != nil || res.Status != engine.VALID {
+		t.Fatalf("have %v %v, want primary answer", res.Status, err)
+	}
+	select {
+	case d := <-ch:
+		if d.Number != 10 || d.Hash != payload.BlockHash || d.Method != "NPV3" {
+			t.Fatalf("wrong divergence: %+v", d)
+		}
+		if len(d.Answers) != 3 || d.Answers[1].EL != "b" || d.Answers[1].Status != engine.INVALID {
+			t.Fatalf("wrong answers: %+v", d.Answers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no divergence raised")
+	}
+	files, _ := os.ReadDir(relay.divergenceDir)
+	if len(files) != 1 {
+		t.Fatalf("have %d reports, want 1", len(files))
+	}
+	// The block number is known for the forkchoice update too.
+	relay.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{HeadBlockHash: payload.BlockHash}, nil)
+	if d := <-ch; d.Number != 10 || d.Method != "FCUV3" {
+		t.Fatalf("wrong divergence: %+v", d)
+	}
+	// No divergence if they agree.
+	b.status = engine.VALID
+	relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+	select {
+	case d := <-ch:
+		t.Fatalf("unexpected divergence: %+v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRelayBuilder(t *testing.T) {
+	var (
+		a, b, c = newMockEL("a"), newMockEL("b"), newMockEL("c")
+		relay   = newRelay([]ElApi{a, b, c})
+		state   = engine.ForkchoiceStateV1{HeadBlockHash: common.Hash{1}}
+		attrs   = &engine.PayloadAttributes{Timestamp: 1}
+	)
+	defer relay.Close()
+	build := func(want *mockEL) {
+		t.Helper()
+		res, err := relay.ForkchoiceUpdated(engine.PayloadV3, state, attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.PayloadID == nil || *res.PayloadID != want.payloadID() {
+			t.Fatalf("have payload id %v, want %v", res.PayloadID, want.payloadID())
+		}
+		env, err := relay.GetPayload(engine.PayloadV3, *res.PayloadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := string(env.ExecutionPayload.ExtraData); have != want.name {
+			t.Fatalf("payload fetched from %s, want %s", have, want.name)
+		}
+	}
+	// Without a designated builder, the primary builds.
+	build(a)
+	// With one, the builder builds unless it is unhealthy.
+	relay.builder = c
+	build(c)
+	c.setHealthy(false)
+	build(a)
+	// Only the building ELs got the payload attributes.
+	count := func(el *mockEL) (n int) {
+		el.mu.Lock()
+		defer el.mu.Unlock()
+		for _, m := range el.methods {
+			if m == "build" {
+				n++
+			}
+		}
+		return n
+	}
+	if count(a) != 2 || count(b) != 0 || count(c) != 1 {
+		t.Fatalf("have builds a=%d b=%d c=%d, want 2, 0, 1", count(a), count(b), count(c))
+	}
+	if _, err := relay.GetPayload(engine.PayloadV3, engine.PayloadID{1}); err != engine.UnknownPayload {
+		t.Fatalf("have %v, want %v", err, engine.UnknownPayload)
+	}
+}
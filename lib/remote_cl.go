@@ -17,22 +17,40 @@
 package lib
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/ethereum/go-ethereum/beacon/engine"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/log"
 )
 
 // remoteCL represents a remote CL client
 type remoteCL struct {
+	name          string
 	address       string
 	client        *http.Client
+	streamClient  *http.Client // client without timeout, for the event stream
 	customHeaders map[string]string
+	metrics       clMetrics
+
+	noSSZ atomic.Bool // set if the node rejected requests for SSZ
+
+	mu       sync.Mutex
+	schedule *forkSchedule // fork schedule of the network, fetched on demand
 }
 
 func newRemoteCL(address, name string, customHeaders map[string]string) (*remoteCL, error) {
@@ -40,16 +58,130 @@ func newRemoteCL(address, name string, customHeaders map[string]string) (*remote
 		Timeout: time.Second * 10,
 	}
 	return &remoteCL{
+		name:          name,
 		address:       address,
 		client:        client,
+		streamClient:  &http.Client{},
 		customHeaders: customHeaders,
+		metrics:       newCLMetrics(name),
 	}, nil
 }
 
-func (r *remoteCL) GetHeadBlock() (resp engine.ExecutableData, beaconRoot common.Hash, err error) {
+// syncingResponse is the response to /eth/v1/node/syncing.
+type syncingResponse struct {
+	Data struct {
+		HeadSlot     math.HexOrDecimal64 `json:"head_slot"`
+		SyncDistance math.HexOrDecimal64 `json:"sync_distance"`
+		IsSyncing    bool                `json:"is_syncing"`
+		IsOptimistic bool                `json:"is_optimistic"`
+	} `json:"data"`
+}
+
+// CheckHealth returns an error if the CL node is not ready to serve as a
+// source of blocks: unreachable, syncing or optimistic.
+func (r *remoteCL) CheckHealth() error {
+	res, err := r.get("eth", "v1", "node", "health")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		return errors.New("node is syncing")
+	default:
+		return fmt.Errorf("health response code %v", res.StatusCode)
+	}
+	var syncing syncingResponse
+	if err := r.getJSON(&syncing, "eth", "v1", "node", "syncing"); err != nil {
+		return err
+	}
+	if syncing.Data.IsSyncing {
+		return fmt.Errorf("node is syncing, distance %d", uint64(syncing.Data.SyncDistance))
+	}
+	if syncing.Data.IsOptimistic {
+		return errors.New("node is optimistic")
+	}
+	return nil
+}
+
+// get performs a GET request against the given API path.
+func (r *remoteCL) get(path ...string) (*http.Response, error) {
+	return r.getAccept("application/json", path...)
+}
+
+// getAccept performs a GET request against the given API path, accepting the
+// given content types.
+func (r *remoteCL) getAccept(accept string, path ...string) (*http.Response, error) {
+	u, err := url.JoinPath(r.address, path...)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.customHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", accept)
+	start := time.Now()
+	res, err := r.client.Do(req)
+	r.metrics.requests.Update(time.Since(start).Milliseconds())
+	if err != nil || res.StatusCode >= http.StatusInternalServerError {
+		r.metrics.failures.Inc(1)
+	}
+	return res, err
+}
+
+// checkpoint is a beacon chain checkpoint.
+type checkpoint struct {
+	Epoch math.HexOrDecimal64 `json:"epoch"`
+	Root  common.Hash         `json:"root"`
+}
+
+// finalityCheckpoints is the response to /eth/v1/beacon/states/{state_id}/finality_checkpoints.
+type finalityCheckpoints struct {
+	Data struct {
+		PreviousJustified checkpoint `json:"previous_justified"`
+		CurrentJustified  checkpoint `json:"current_justified"`
+		Finalized         checkpoint `json:"finalized"`
+	} `json:"data"`
+}
+
+// GetFinalityCheckpoints fetches the justified and finalized checkpoints of the
+// head state.
+func (r *remoteCL) GetFinalityCheckpoints() (*finalityCheckpoints, error) {
+	var resp finalityCheckpoints
+	if err := r.getJSON(&resp, "eth", "v1", "beacon", "states", "head", "finality_checkpoints"); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// blobSidecar is a blob sidecar, as returned by /eth/v1/beacon/blob_sidecars.
+type blobSidecar struct {
+	Index         math.HexOrDecimal64 `json:"index"`
+	Blob          *kzg4844.Blob       `json:"blob"`
+	KzgCommitment kzg4844.Commitment  `json:"kzg_commitment"`
+	KzgProof      kzg4844.Proof       `json:"kzg_proof"`
+}
+
+// GetBlobSidecars fetches the blob sidecars of the given block.
+func (r *remoteCL) GetBlobSidecars(specifier string) ([]blobSidecar, error) {
+	var resp struct {
+		Data []blobSidecar `json:"data"`
+	}
+	if err := r.getJSON(&resp, "eth", "v1", "beacon", "blob_sidecars", specifier); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (r *remoteCL) GetHeadBlock() (*clBlock, error) {
 	return r.GetBlock("head")
 }
-func (r *remoteCL) GetFinalizedBlock() (resp engine.ExecutableData, beaconRoot common.Hash, err error) {
+func (r *remoteCL) GetFinalizedBlock() (*clBlock, error) {
 	return r.GetBlock("finalized")
 }
 
@@ -57,34 +189,279 @@ func (r *remoteCL) GetFinalizedBlock() (resp engine.ExecutableData, beaconRoot c
 // - "finalized",
 // - "head",
 // - a number
-func (r *remoteCL) GetBlock(specifier string) (resp engine.ExecutableData, beaconRoot common.Hash, err error) {
+// - a beacon block root
+func (r *remoteCL) GetBlock(specifier string) (*clBlock, error) {
+	accept := "application/json"
+	if !r.noSSZ.Load() {
+		accept = "application/octet-stream;q=1.0,application/json;q=0.9"
+	}
+	res, err := r.getAccept(accept, "eth", "v2", "beacon", "blocks", specifier)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotAcceptable || res.StatusCode == http.StatusUnsupportedMediaType {
+		if !r.noSSZ.Swap(true) {
+			log.Info("CL does not support SSZ, falling back to JSON", "name", r.name)
+			return r.GetBlock(specifier)
+		}
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusOK && strings.HasPrefix(res.Header.Get("Content-Type"), "application/octet-stream") {
+		name := res.Header.Get("Eth-Consensus-Version")
+		f := parseFork(name)
+		if f == forkUnknown {
+			return nil, fmt.Errorf("unknown fork %q in SSZ response", name)
+		}
+		block, err := decodeSSZBlock(f, body)
+		if err != nil {
+			return nil, err
+		}
+		block.raw, block.rawFormat = body, "ssz"
+		return block, nil
+	}
+	return r.decodeJSONBlock(res.StatusCode, body)
+}
+
+// decodeJSONBlock decodes a beacon block response in JSON format.
+func (r *remoteCL) decodeJSONBlock(status int, body []byte) (*clBlock, error) {
 	var internal bellatrixBlock
-	u, err := url.JoinPath(r.address, "eth", "v2", "beacon", "blocks", specifier)
+	err := json.Unmarshal(body, &internal)
 	if err != nil {
-		return resp, common.Hash{}, err
+		return nil, fmt.Errorf("response code %v, err: %w", status, err)
 	}
-	req, err := http.NewRequest("GET", u, nil)
+	var (
+		message = internal.Data.Message
+		payload = message.Body.ExecutionPayload
+		f       = parseFork(internal.Version)
+	)
+	if f == forkUnknown {
+		// No usable version in the response, go by the fork schedule.
+		if f, err = r.forkAt(uint64(payload.Timestamp)); err != nil {
+			return nil, fmt.Errorf("unknown fork %q: %w", internal.Version, err)
+		}
+	}
+	block := &clBlock{
+		fork:       f,
+		slot:       uint64(message.Slot),
+		parentRoot: message.ParentRoot,
+		execData:   payload.toExecutableData(f),
+		raw:        body,
+		rawFormat:  "json",
+	}
+	if f >= forkDeneb {
+		if message.Body.BlobKzgCommitments == nil {
+			return nil, errors.New("missing blob commitments")
+		}
+		block.commitments = message.Body.BlobKzgCommitments
+	}
+	if f >= forkElectra {
+		if message.Body.ExecutionRequests == nil {
+			return nil, errors.New("missing execution requests")
+		}
+		if block.requests, err = message.Body.ExecutionRequests.encode(); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// forkSchedule holds the fork activation times of the network.
+type forkSchedule struct {
+	genesisTime    uint64
+	secondsPerSlot uint64
+	slotsPerEpoch  uint64
+	epochs         map[fork]uint64 // activation epoch per fork
+}
+
+// forkAt returns the fork active at the given timestamp.
+func (s *forkSchedule) forkAt(timestamp uint64) fork {
+	if timestamp < s.genesisTime || s.secondsPerSlot == 0 || s.slotsPerEpoch == 0 {
+		return forkUnknown
+	}
+	var (
+		epoch  = (timestamp - s.genesisTime) / s.secondsPerSlot / s.slotsPerEpoch
+		active = forkUnknown
+	)
+	for f, activation := range s.epochs {
+		if epoch >= activation && f > active {
+			active = f
+		}
+	}
+	return active
+}
+
+// forkAt returns the fork active at the given timestamp, as per the fork
+// schedule of the CL node. The schedule is fetched on first use.
+func (r *remoteCL) forkAt(timestamp uint64) (fork, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schedule == nil {
+		schedule, err := r.GetForkSchedule()
+		if err != nil {
+			return forkUnknown, err
+		}
+		r.schedule = schedule
+	}
+	if f := r.schedule.forkAt(timestamp); f != forkUnknown {
+		return f, nil
+	}
+	return forkUnknown, fmt.Errorf("no fork scheduled at timestamp %d", timestamp)
+}
+
+// GetForkSchedule fetches the genesis time and the fork epochs of the network,
+// through /eth/v1/beacon/genesis and /eth/v1/config/spec.
+func (r *remoteCL) GetForkSchedule() (*forkSchedule, error) {
+	var genesis struct {
+		Data struct {
+			GenesisTime math.HexOrDecimal64 `json:"genesis_time"`
+		} `json:"data"`
+	}
+	if err := r.getJSON(&genesis, "eth", "v1", "beacon", "genesis"); err != nil {
+		return nil, err
+	}
+	var spec struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := r.getJSON(&spec, "eth", "v1", "config", "spec"); err != nil {
+		return nil, err
+	}
+	number := func(key string) (uint64, bool) {
+		v, ok := spec.Data[key]
+		if !ok {
+			return 0, false
+		}
+		return math.ParseUint64(v)
+	}
+	schedule := &forkSchedule{
+		genesisTime: uint64(genesis.Data.GenesisTime),
+		epochs:      make(map[fork]uint64),
+	}
+	schedule.secondsPerSlot, _ = number("SECONDS_PER_SLOT")
+	schedule.slotsPerEpoch, _ = number("SLOTS_PER_EPOCH")
+	for f, name := range forkNames {
+		if epoch, ok := number(strings.ToUpper(name) + "_FORK_EPOCH"); ok {
+			schedule.epochs[f] = epoch
+		}
+	}
+	return schedule, nil
+}
+
+// getJSON performs a GET request against the given API path, and decodes the
+// JSON response into result.
+func (r *remoteCL) getJSON(result interface{}, path ...string) error {
+	res, err := r.get(path...)
 	if err != nil {
-		return resp, common.Hash{}, err
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// Error bodies would decode into zero values, so don't try.
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("response code %v: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return fmt.Errorf("response code %v, err: %w", res.StatusCode, err)
+	}
+	return nil
+}
+
+// clEvent is a single event received over the beacon node event stream.
+type clEvent struct {
+	Topic string
+	Data  json.RawMessage
+}
+
+// headEvent is the payload of the 'head' topic.
+type headEvent struct {
+	Slot            math.HexOrDecimal64 `json:"slot"`
+	Block           common.Hash         `json:"block"`
+	EpochTransition bool                `json:"epoch_transition"`
+}
+
+// finalizedCheckpointEvent is the payload of the 'finalized_checkpoint' topic.
+type finalizedCheckpointEvent struct {
+	Block common.Hash         `json:"block"`
+	Epoch math.HexOrDecimal64 `json:"epoch"`
+}
+
+// chainReorgEvent is the payload of the 'chain_reorg' topic.
+type chainReorgEvent struct {
+	Slot         math.HexOrDecimal64 `json:"slot"`
+	Depth        math.HexOrDecimal64 `json:"depth"`
+	OldHeadBlock common.Hash         `json:"old_head_block"`
+	NewHeadBlock common.Hash         `json:"new_head_block"`
+}
+
+// eventStream is an open server-sent-events subscription on the CL node.
+type eventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// SubscribeEvents opens the event stream for the given topics. The stream is
+// closed when the context is cancelled or Close is called.
+func (r *remoteCL) SubscribeEvents(ctx context.Context, topics []string) (*eventStream, error) {
+	u, err := url.JoinPath(r.address, "eth", "v1", "events")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u+"?topics="+strings.Join(topics, ","), nil)
+	if err != nil {
+		return nil, err
 	}
 	for k, v := range r.customHeaders {
 		req.Header.Set(k, v)
 	}
-	res, err := r.client.Do(req)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := r.streamClient.Do(req)
 	if err != nil {
-		return resp, common.Hash{}, err
+		return nil, err
 	}
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return resp, common.Hash{}, err
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("response code %v", res.StatusCode)
 	}
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	return &eventStream{body: res.Body, scanner: scanner}, nil
+}
 
-	err = json.Unmarshal(body, &internal)
-	if err != nil {
-		return resp, common.Hash{}, fmt.Errorf("response code %v, err: %w", res.StatusCode, err)
+// Next blocks until the next event is received.
+func (s *eventStream) Next() (clEvent, error) {
+	var (
+		ev   clEvent
+		data []byte
+	)
+	for s.scanner.Scan() {
+		line := s.scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			// A blank line dispatches the event, if there is one.
+			if ev.Topic != "" || len(data) > 0 {
+				ev.Data = data
+				return ev, nil
+			}
+		case bytes.HasPrefix(line, []byte(":")):
+			// Comment, used as keep-alive by some clients.
+		case bytes.HasPrefix(line, []byte("event:")):
+			ev.Topic = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimSpace(line[len("data:"):])...)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return ev, err
 	}
-	beaconRoot = internal.Data.Message.ParentRoot
-	resp = internal.Data.Message.Body.ExecutionPayload.toExecutableDataV1()
+	return ev, errors.New("event stream closed")
+}
 
-	return resp, beaconRoot, nil
+func (s *eventStream) Close() error {
+	return s.body.Close()
 }
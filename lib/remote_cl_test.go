@@ -0,0 +1,110 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestEventStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if have, want := r.URL.Query().Get("topics"), "head,finalized_checkpoint"; have != want {
+			t.Errorf("topics: have %q, want %q", have, want)
+		}
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "event: head\ndata: {\"slot\":\"10\", \"block\":\"0x9a2fefd2fdb57f74993c7780ea5b9030d2897b615b89f808011ca5aebed54eaf\"}\n\n")
+		fmt.Fprint(w, "event: finalized_checkpoint\ndata: {\"block\":\"0x9a2fefd2fdb57f74993c7780ea5b9030d2897b615b89f808011ca5aebed54eaf\",\"epoch\":\"2\"}\n\n")
+	}))
+	defer srv.Close()
+
+	cl, _ := newRemoteCL(srv.URL, "test", nil)
+	stream, err := cl.SubscribeEvents(context.Background(), []string{"head", "finalized_checkpoint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	ev, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Topic != "head" {
+		t.Fatalf("have topic %q, want head", ev.Topic)
+	}
+	var head headEvent
+	if err := json.Unmarshal(ev.Data, &head); err != nil {
+		t.Fatal(err)
+	}
+	if head.Slot != 10 || head.Block != common.HexToHash("0x9a2fefd2fdb57f74993c7780ea5b9030d2897b615b89f808011ca5aebed54eaf") {
+		t.Fatalf("wrong head event: %+v", head)
+	}
+	if ev, err = stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+	var final finalizedCheckpointEvent
+	if err := json.Unmarshal(ev.Data, &final); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Topic != "finalized_checkpoint" || final.Epoch != 2 {
+		t.Fatalf("wrong finalized event: %v %+v", ev.Topic, final)
+	}
+	if _, err := stream.Next(); err == nil {
+		t.Fatal("expected error at end of stream")
+	}
+}
+
+func TestForkSchedule(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/eth/v1/beacon/genesis":
+			fmt.Fprint(w, `{"data":{"genesis_time":"1606824023"}}`)
+		case "/eth/v1/config/spec":
+			fmt.Fprint(w, `{"data":{"SECONDS_PER_SLOT":"12","SLOTS_PER_EPOCH":"32","BELLATRIX_FORK_EPOCH":"144896","CAPELLA_FORK_EPOCH":"194048","DENEB_FORK_EPOCH":"269568"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cl, _ := newRemoteCL(srv.URL, "test", nil)
+	for i, tt := range []struct {
+		timestamp uint64
+		want      fork
+	}{
+		{1681338455 - 12, forkBellatrix}, // last block before Shanghai
+		{1681338455, forkCapella},        // Shanghai
+		{1710338135, forkDeneb},          // Cancun
+	} {
+		have, err := cl.forkAt(tt.timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tt.want {
+			t.Errorf("test %d: have %v, want %v", i, have, tt.want)
+		}
+	}
+	if _, err := cl.forkAt(1606824023 - 1); err == nil {
+		t.Error("expected error before genesis")
+	}
+}
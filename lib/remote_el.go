@@ -18,119 +18,192 @@ package lib
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/beacon/engine"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
-const errBackoffCount = 6
-const backOffPeriod = 2 * time.Minute
 const contextDeadline = 6 * time.Second
 
 // remoteEL represents a remote Execution Layer client.
 type remoteEL struct {
-	name       string
-	cli        *rpc.Client
-	pauseUntil time.Time
-	errCount   int
+	name      string
+	cli       *rpc.Client
+	breaker   *breaker
+	refreshCh chan struct{}      // requests a refresh of the version and capabilities
+	ctx       context.Context    // cancelled on close, aborts the refreshes
+	cancel    context.CancelFunc // closes the context
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	caps     map[string]bool         // supported engine API methods, nil if not known
+	version  *engine.ClientVersionV1 // client version, nil if not known
+	headFork fork                    // fork of the last payload sent
 }
 
-func newRemoteEL(addr, name string, jwtSecret string, customHeaders map[string]string) (*remoteEL, error) {
+func newRemoteEL(conf ELConfig, breakerEvents *event.Feed) (*remoteEL, error) {
 
 	var opts []rpc.ClientOption
-	if sec := common.HexToHash(jwtSecret); sec != (common.Hash{}) {
+	if sec := common.HexToHash(conf.JwtSecret); sec != (common.Hash{}) {
 		opts = append(opts, rpc.WithHTTPAuth(node.NewJWTAuth(sec)))
 	} else {
 		log.Warn("Using empty jwt-secret")
 	}
-	for k, v := range customHeaders {
+	for k, v := range conf.Headers {
 		opts = append(opts, rpc.WithHeader(k, v))
 	}
-	client, err := rpc.DialOptions(context.Background(), addr, opts...)
+	client, err := rpc.DialOptions(context.Background(), conf.Address, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return &remoteEL{
-		name: name,
-		cli:  client,
-	}, nil
+	el := &remoteEL{
+		name:      conf.Name,
+		cli:       client,
+		breaker:   newBreaker(conf, breakerEvents),
+		refreshCh: make(chan struct{}, 1),
+	}
+	el.ctx, el.cancel = context.WithCancel(context.Background())
+	el.breaker.identity = el.Identity
+	el.wg.Add(1)
+	go el.refreshLoop()
+	return el, nil
+}
+
+// call performs an engine API call through the circuit breaker. Error
+// responses from the EL show that it is up, so they don't count as failures.
+// Once the EL recovers, its client version and capabilities are refreshed, as
+// it may have been restarted with a different build.
+func (r *remoteEL) call(result interface{}, method string, args ...interface{}) error {
+	down := r.breaker.State() != breakerClosed
+	if err := r.breaker.allow(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), contextDeadline)
+	defer cancel()
+	err := r.cli.CallContext(ctx, result, method, args...)
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		r.breaker.done(nil)
+	} else {
+		r.breaker.done(err)
+	}
+	if down && r.breaker.State() == breakerClosed {
+		select {
+		case r.refreshCh <- struct{}{}:
+		default:
+		}
+	}
+	return err
 }
 
-func (r *remoteEL) ForkchoiceUpdatedV1(update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
-	var raw json.RawMessage
+// query performs a call outside the circuit breaker, for the bookkeeping calls
+// which should neither be refused nor count as failures.
+func (r *remoteEL) query(result interface{}, method string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(r.ctx, contextDeadline)
+	defer cancel()
+	return r.cli.CallContext(ctx, result, method, args...)
+}
+
+func (r *remoteEL) ForkchoiceUpdated(version engine.PayloadVersion, update engine.ForkchoiceStateV1, payloadAttributes *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
 	var resp engine.ForkChoiceResponse
-	ctx, _ := context.WithDeadline(context.Background(), time.Now().Add(contextDeadline))
-	err := r.cli.CallContext(ctx, &raw, "engine_forkchoiceUpdatedV1", update, payloadAttributes)
+	r.mu.Lock()
+	f := max(r.headFork, attributesFork(payloadAttributes))
+	r.mu.Unlock()
+	version, err := r.methodVersion("engine_forkchoiceUpdatedV", version, f.forkchoiceVersion())
 	if err != nil {
-		r.errCount++
-		return resp, err
-	}
-	if err := json.Unmarshal(raw, &resp); err != nil {
 		return resp, err
 	}
-	r.errCount = 0
-	return resp, nil
+	err = r.call(&resp, fmt.Sprintf("engine_forkchoiceUpdatedV%d", version), update, payloadAttributes)
+	return resp, err
 }
 
-func (r *remoteEL) NewPayloadV3(params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash) (engine.PayloadStatusV1, error) {
+func (r *remoteEL) NewPayload(version engine.PayloadVersion, params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash, executionRequests [][]byte) (engine.PayloadStatusV1, error) {
 	var (
-		raw  json.RawMessage
 		resp engine.PayloadStatusV1
+		err  error
 	)
-	if time.Now().Before(r.pauseUntil) {
-		return resp, errors.New("client paused")
-	}
-	if r.errCount == errBackoffCount {
-		log.Info("Pausing client", "EL", r.name, "duration", backOffPeriod)
-		r.pauseUntil = time.Now().Add(backOffPeriod)
-		r.errCount = 0
-		// back off a bit
-	}
-	ctx, _ := context.WithDeadline(context.Background(), time.Now().Add(contextDeadline))
-	err := r.cli.CallContext(ctx, &raw, "engine_newPayloadV3", params, versionedHashes, beaconRoot)
-	if err != nil {
-		r.errCount++
+	f := payloadFork(params, beaconRoot, executionRequests)
+	r.mu.Lock()
+	r.headFork = f
+	r.mu.Unlock()
+	if version, err = r.methodVersion("engine_newPayloadV", version, f.payloadVersion()); err != nil {
 		return resp, err
 	}
-	if err := json.Unmarshal(raw, &resp); err != nil {
-		return resp, err
+	switch version {
+	case engine.PayloadV1, engine.PayloadV2:
+		err = r.call(&resp, fmt.Sprintf("engine_newPayloadV%d", version), params)
+	case engine.PayloadV3:
+		err = r.call(&resp, "engine_newPayloadV3", params, versionedHashes, beaconRoot)
+	case payloadV4:
+		err = r.call(&resp, "engine_newPayloadV4", params, versionedHashes, beaconRoot, toHexBytes(executionRequests))
+	default:
+		return resp, fmt.Errorf("unsupported newPayload version %d", version)
 	}
-	r.errCount = 0
-	return resp, nil
+	return resp, err
 }
 
-func (r *remoteEL) ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error) {
-	if time.Now().Before(r.pauseUntil) {
-		return nil, errors.New("client paused")
+func toHexBytes(list [][]byte) []hexutil.Bytes {
+	enc := make([]hexutil.Bytes, len(list))
+	for i, b := range list {
+		enc[i] = b
 	}
-	if r.errCount == errBackoffCount {
-		log.Info("Pausing client", "EL", r.name, "duration", backOffPeriod)
-		r.pauseUntil = time.Now().Add(backOffPeriod)
-		r.errCount = 0
-		// back off a bit
+	return enc
+}
+
+func (r *remoteEL) ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error) {
+	var resp engine.TransitionConfigurationV1
+	if err := r.call(&resp, "engine_exchangeTransitionConfigurationV1", config); err != nil {
+		return nil, err
 	}
-	var raw json.RawMessage
-	err := r.cli.CallContext(context.Background(), &raw, "engine_exchangeTransitionConfigurationV1", config)
+	return &resp, nil
+}
+
+func (r *remoteEL) GetPayload(version engine.PayloadVersion, payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error) {
+	// The response format depends on the version, so it is never downgraded.
+	version, err := r.methodVersion("engine_getPayloadV", version, version)
 	if err != nil {
 		return nil, err
 	}
-	var resp engine.TransitionConfigurationV1
-	if err := json.Unmarshal(raw, &resp); err != nil {
-		return nil, err
+	switch version {
+	case engine.PayloadV1:
+		// V1 returns the bare payload, without the envelope.
+		var resp engine.ExecutableData
+		if err := r.call(&resp, "engine_getPayloadV1", payloadID); err != nil {
+			return nil, err
+		}
+		return &engine.ExecutionPayloadEnvelope{ExecutionPayload: &resp}, nil
+	case engine.PayloadV2, engine.PayloadV3, payloadV4:
+		var resp engine.ExecutionPayloadEnvelope
+		if err := r.call(&resp, fmt.Sprintf("engine_getPayloadV%d", version), payloadID); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	default:
+		return nil, fmt.Errorf("unsupported getPayload version %d", version)
 	}
-	return &resp, nil
 }
 
-func (r *remoteEL) GetPayloadV1(payloadID engine.PayloadID) (*engine.ExecutableData, error) {
-	return nil, errors.New("GetPayloadV1 not supported")
+// Healthy reports whether the circuit breaker of the client is closed.
+func (r *remoteEL) Healthy() bool {
+	return r.breaker.State() == breakerClosed
 }
 
 func (r *remoteEL) Name() string {
 	return r.name
 }
+
+// Close stops the refreshes, and closes the connection to the client.
+func (r *remoteEL) Close() {
+	r.cancel()
+	r.wg.Wait()
+	r.cli.Close()
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// engineAPI is the engine API served to the CL in passive mode. Calls are
+// relayed to all ELs, and answered with the response of the primary.
+type engineAPI struct {
+	relay ElApi
+}
+
+func (api *engineAPI) ForkchoiceUpdatedV1(update engine.ForkchoiceStateV1, attrs *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	return api.relay.ForkchoiceUpdated(engine.PayloadV1, update, attrs)
+}
+
+func (api *engineAPI) ForkchoiceUpdatedV2(update engine.ForkchoiceStateV1, attrs *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	return api.relay.ForkchoiceUpdated(engine.PayloadV2, update, attrs)
+}
+
+func (api *engineAPI) ForkchoiceUpdatedV3(update engine.ForkchoiceStateV1, attrs *engine.PayloadAttributes) (engine.ForkChoiceResponse, error) {
+	return api.relay.ForkchoiceUpdated(engine.PayloadV3, update, attrs)
+}
+
+func (api *engineAPI) NewPayloadV1(params engine.ExecutableData) (engine.PayloadStatusV1, error) {
+	return api.relay.NewPayload(engine.PayloadV1, params, nil, nil, nil)
+}
+
+func (api *engineAPI) NewPayloadV2(params engine.ExecutableData) (engine.PayloadStatusV1, error) {
+	return api.relay.NewPayload(engine.PayloadV2, params, nil, nil, nil)
+}
+
+func (api *engineAPI) NewPayloadV3(params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash) (engine.PayloadStatusV1, error) {
+	return api.relay.NewPayload(engine.PayloadV3, params, versionedHashes, beaconRoot, nil)
+}
+
+func (api *engineAPI) NewPayloadV4(params engine.ExecutableData, versionedHashes []common.Hash, beaconRoot *common.Hash, executionRequests []hexutil.Bytes) (engine.PayloadStatusV1, error) {
+	requests := make([][]byte, len(executionRequests))
+	for i, req := range executionRequests {
+		requests[i] = req
+	}
+	return api.relay.NewPayload(payloadV4, params, versionedHashes, beaconRoot, requests)
+}
+
+func (api *engineAPI) GetPayloadV1(payloadID engine.PayloadID) (*engine.ExecutableData, error) {
+	env, err := api.relay.GetPayload(engine.PayloadV1, payloadID)
+	if err != nil {
+		return nil, err
+	}
+	return env.ExecutionPayload, nil
+}
+
+func (api *engineAPI) GetPayloadV2(payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error) {
+	return api.relay.GetPayload(engine.PayloadV2, payloadID)
+}
+
+func (api *engineAPI) GetPayloadV3(payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error) {
+	return api.relay.GetPayload(engine.PayloadV3, payloadID)
+}
+
+func (api *engineAPI) GetPayloadV4(payloadID engine.PayloadID) (*engine.ExecutionPayloadEnvelope, error) {
+	return api.relay.GetPayload(payloadV4, payloadID)
+}
+
+func (api *engineAPI) ExchangeTransitionConfigurationV1(config engine.TransitionConfigurationV1) (*engine.TransitionConfigurationV1, error) {
+	return api.relay.ExchangeTransitionConfigurationV1(config)
+}
+
+// GetClientVersionV1 identifies Factor to the CL, followed by the client version
+// of the primary EL if it is known.
+func (api *engineAPI) GetClientVersionV1(engine.ClientVersionV1) []engine.ClientVersionV1 {
+	versions := []engine.ClientVersionV1{factorVersion}
+	if v := clientVersion(api.relay); v != nil {
+		versions = append(versions, *v)
+	}
+	return versions
+}
+
+// ExchangeCapabilities returns the engine API methods served by Factor.
+func (api *engineAPI) ExchangeCapabilities([]string) []string {
+	return engineMethods
+}
+
+// engineServer serves the engine API to the CL in passive mode.
+type engineServer struct {
+	*httpServer
+	rpc *rpc.Server
+}
+
+// NewEngineServer creates the engine API server, relaying calls to the sink.
+func NewEngineServer(config PassiveConfig, sink ElApi) (*engineServer, error) {
+	secret := common.FromHex(config.JwtSecret)
+	if len(secret) != 32 {
+		return nil, errors.New("passive mode requires a 32 byte jwt secret")
+	}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("engine", &engineAPI{relay: sink}); err != nil {
+		return nil, err
+	}
+	return &engineServer{
+		httpServer: newHTTPServer("engine", config.Listen, node.NewHTTPHandlerStack(srv, nil, []string{"*"}, secret)),
+		rpc:        srv,
+	}, nil
+}
+
+// Stop shuts the server down.
+func (s *engineServer) Stop() {
+	s.httpServer.Stop()
+	s.rpc.Stop()
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// versionedEL is a mock EL which reports its client version.
+type versionedEL struct {
+	*mockEL
+	version engine.ClientVersionV1
+}
+
+func (el *versionedEL) ClientVersion() *engine.ClientVersionV1 { return &el.version }
+
+func TestEngineServer(t *testing.T) {
+	var (
+		primary = &versionedEL{newMockEL("primary"), engine.ClientVersionV1{Code: "GE", Name: "go-ethereum", Version: "1.15.11", Commit: "0x36b2371c"}}
+		other   = newMockEL("other")
+		relay   = newRelay([]ElApi{primary, other})
+		secret  = common.Hash{1}
+	)
+	defer relay.Close()
+	other.status = engine.SYNCING
+
+	srv, err := NewEngineServer(PassiveConfig{Listen: "127.0.0.1:0", JwtSecret: secret.Hex()}, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	url := fmt.Sprintf("http://%v", srv.listener.Addr())
+
+	cli, err := rpc.DialOptions(context.Background(), url, rpc.WithHTTPAuth(node.NewJWTAuth(secret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	var res engine.PayloadStatusV1
+	payload := engine.ExecutableData{
+		Number:        1,
+		BlockHash:     common.Hash{1},
+		ParentHash:    common.Hash{2},
+		BaseFeePerGas: big.NewInt(1),
+		Transactions:  [][]byte{},
+	}
+	if err := cli.Call(&res, "engine_newPayloadV1", payload); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != engine.VALID {
+		t.Fatalf("have status %s, want %s", res.Status, engine.VALID)
+	}
+	primary.waitCalls(t, 1)
+	other.waitCalls(t, 1)
+
+	// Factor identifies itself, followed by the primary EL.
+	var versions []engine.ClientVersionV1
+	if err := cli.Call(&versions, "engine_getClientVersionV1", engine.ClientVersionV1{Code: "LH", Name: "lighthouse"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []engine.ClientVersionV1{factorVersion, primary.version}; !slices.Equal(versions, want) {
+		t.Fatalf("have client versions %v, want %v", versions, want)
+	}
+	var methods []string
+	if err := cli.Call(&methods, "engine_exchangeCapabilities", []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(methods, "engine_getClientVersionV1") {
+		t.Fatalf("engine_getClientVersionV1 not advertised: %v", methods)
+	}
+
+	// Calls with the wrong secret are refused.
+	bad, err := rpc.DialOptions(context.Background(), url, rpc.WithHTTPAuth(node.NewJWTAuth(common.Hash{2})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if err := bad.Call(&res, "engine_newPayloadV1", payload); err == nil {
+		t.Fatal("call with wrong secret accepted")
+	}
+	primary.waitCalls(t, 1)
+}
+
+func TestEngineServerSecret(t *testing.T) {
+	if _, err := NewEngineServer(PassiveConfig{Listen: "127.0.0.1:0"}, nil); err == nil {
+		t.Fatal("server created without jwt secret")
+	}
+}
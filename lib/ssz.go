@@ -0,0 +1,240 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+)
+
+// This file implements just enough of SSZ to pull the execution payload and
+// the related fields out of a SignedBeaconBlock, without decoding the rest of
+// the block.
+
+var errShortSSZ = errors.New("ssz: input too short")
+
+// Sizes of the fixed parts of the containers, and of fixed-size list items.
+const (
+	sszSignedBlockSize   = 4 + 96               // message offset, signature
+	sszBlockSize         = 8 + 8 + 32 + 32 + 4  // slot, proposer, parent root, state root, body offset
+	sszWithdrawalSize    = 8 + 8 + 20 + 8       // index, validator, address, amount
+	sszCommitmentSize    = 48                   // KZG commitment
+	sszDepositSize       = 48 + 32 + 8 + 96 + 8 // pubkey, credentials, amount, signature, index
+	sszWithdrawalReqSize = 20 + 48 + 8          // address, pubkey, amount
+	sszConsolidationSize = 20 + 48 + 48         // address, source pubkey, target pubkey
+)
+
+// sszParts splits an SSZ container into its variable-size fields, given the
+// size of the fixed part and the positions of the offsets within it.
+func sszParts(buf []byte, fixedSize int, offsetPos ...int) ([][]byte, error) {
+	if len(buf) < fixedSize {
+		return nil, errShortSSZ
+	}
+	offsets := make([]int, len(offsetPos)+1)
+	for i, pos := range offsetPos {
+		offsets[i] = int(binary.LittleEndian.Uint32(buf[pos:]))
+	}
+	offsets[len(offsetPos)] = len(buf)
+	if len(offsetPos) > 0 && offsets[0] != fixedSize {
+		return nil, fmt.Errorf("ssz: first offset %d, want %d", offsets[0], fixedSize)
+	}
+	parts := make([][]byte, len(offsetPos))
+	for i := range offsetPos {
+		if offsets[i] > offsets[i+1] {
+			return nil, fmt.Errorf("ssz: offset %d out of order", i)
+		}
+		parts[i] = buf[offsets[i]:offsets[i+1]]
+	}
+	return parts, nil
+}
+
+// sszByteLists decodes a list of variable-size byte lists.
+func sszByteLists(buf []byte) ([][]byte, error) {
+	if len(buf) == 0 {
+		return [][]byte{}, nil
+	}
+	if len(buf) < 4 {
+		return nil, errShortSSZ
+	}
+	first := int(binary.LittleEndian.Uint32(buf))
+	if first == 0 || first%4 != 0 {
+		return nil, fmt.Errorf("ssz: invalid list offset %d", first)
+	}
+	positions := make([]int, first/4)
+	for i := range positions {
+		positions[i] = i * 4
+	}
+	return sszParts(buf, first, positions...)
+}
+
+// sszFixedList checks that buf is a list of items of the given size, and
+// returns the number of items.
+func sszFixedList(buf []byte, size int, name string) (int, error) {
+	if len(buf)%size != 0 {
+		return 0, fmt.Errorf("ssz: %s list length %d not a multiple of %d", name, len(buf), size)
+	}
+	return len(buf) / size, nil
+}
+
+// decodeSSZBlock decodes an SSZ-encoded SignedBeaconBlock of the given fork.
+func decodeSSZBlock(f fork, data []byte) (*clBlock, error) {
+	if f < forkBellatrix {
+		return nil, fmt.Errorf("ssz: unsupported fork %v", f)
+	}
+	signed, err := sszParts(data, sszSignedBlockSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	message := signed[0]
+	block, err := sszParts(message, sszBlockSize, 80)
+	if err != nil {
+		return nil, err
+	}
+	// The body starts with randao reveal (96), eth1 data (72) and graffiti
+	// (32), followed by five list offsets, the sync aggregate (160), and the
+	// execution payload offset. Later forks append more offsets.
+	var (
+		offsets  = []int{200, 204, 208, 212, 216, 380}
+		bodySize = 384
+	)
+	for later := forkCapella; later <= f; later++ {
+		offsets = append(offsets, bodySize)
+		bodySize += 4
+	}
+	body, err := sszParts(block[0], bodySize, offsets...)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := decodeSSZPayload(f, body[5])
+	if err != nil {
+		return nil, err
+	}
+	result := &clBlock{
+		fork:       f,
+		slot:       binary.LittleEndian.Uint64(message[0:]),
+		parentRoot: common.BytesToHash(message[16:48]),
+		execData:   payload.toExecutableData(f),
+	}
+	if f >= forkDeneb {
+		n, err := sszFixedList(body[7], sszCommitmentSize, "blob commitments")
+		if err != nil {
+			return nil, err
+		}
+		result.commitments = make([]kzg4844.Commitment, n)
+		for i := range result.commitments {
+			copy(result.commitments[i][:], body[7][i*sszCommitmentSize:])
+		}
+	}
+	if f >= forkElectra {
+		if result.requests, err = decodeSSZRequests(body[8]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// decodeSSZPayload decodes an SSZ-encoded ExecutionPayload of the given fork.
+func decodeSSZPayload(f fork, buf []byte) (*beaconBlock, error) {
+	var (
+		offsets   = []int{436, 504}
+		fixedSize = 508
+	)
+	if f >= forkCapella {
+		offsets = append(offsets, 508)
+		fixedSize = 512
+	}
+	if f >= forkDeneb {
+		fixedSize = 528
+	}
+	parts, err := sszParts(buf, fixedSize, offsets...)
+	if err != nil {
+		return nil, err
+	}
+	// The base fee is a little-endian uint256.
+	baseFee := make([]byte, 32)
+	for i := range baseFee {
+		baseFee[i] = buf[440+31-i]
+	}
+	payload := &beaconBlock{
+		ParentHash:    common.BytesToHash(buf[0:32]),
+		FeeRecipient:  common.BytesToAddress(buf[32:52]),
+		StateRoot:     common.BytesToHash(buf[52:84]),
+		ReceiptsRoot:  common.BytesToHash(buf[84:116]),
+		LogsBloom:     common.CopyBytes(buf[116:372]),
+		Random:        common.BytesToHash(buf[372:404]),
+		Number:        binary.LittleEndian.Uint64(buf[404:]),
+		GasLimit:      binary.LittleEndian.Uint64(buf[412:]),
+		GasUsed:       binary.LittleEndian.Uint64(buf[420:]),
+		Timestamp:     binary.LittleEndian.Uint64(buf[428:]),
+		ExtraData:     common.CopyBytes(parts[0]),
+		BaseFeePerGas: new(big.Int).SetBytes(baseFee),
+		BlockHash:     common.BytesToHash(buf[472:504]),
+	}
+	if payload.Transactions, err = sszByteLists(parts[1]); err != nil {
+		return nil, err
+	}
+	if f >= forkCapella {
+		n, err := sszFixedList(parts[2], sszWithdrawalSize, "withdrawals")
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			w := parts[2][i*sszWithdrawalSize:]
+			payload.Withdrawals = append(payload.Withdrawals, &clWithDrawal{
+				Index:     math.HexOrDecimal64(binary.LittleEndian.Uint64(w[0:])),
+				Validator: math.HexOrDecimal64(binary.LittleEndian.Uint64(w[8:])),
+				Address:   common.BytesToAddress(w[16:36]),
+				Amount:    math.HexOrDecimal64(binary.LittleEndian.Uint64(w[36:])),
+			})
+		}
+	}
+	if f >= forkDeneb {
+		payload.BlobGasUsed = binary.LittleEndian.Uint64(buf[512:])
+		payload.ExcessBlobGas = binary.LittleEndian.Uint64(buf[520:])
+	}
+	return payload, nil
+}
+
+// decodeSSZRequests decodes SSZ-encoded ExecutionRequests into the engine API
+// format. Since that format is the SSZ encoding of each list prefixed with
+// the request type, the lists only need to be validated.
+func decodeSSZRequests(buf []byte) ([][]byte, error) {
+	lists, err := sszParts(buf, 12, 0, 4, 8)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		requests = make([][]byte, 0, 3)
+		sizes    = []int{sszDepositSize, sszWithdrawalReqSize, sszConsolidationSize}
+		names    = []string{"deposit", "withdrawal", "consolidation"}
+	)
+	for typ, list := range lists {
+		if _, err := sszFixedList(list, sizes[typ], names[typ]); err != nil {
+			return nil, err
+		}
+		if len(list) > 0 {
+			requests = append(requests, append([]byte{byte(typ)}, list...))
+		}
+	}
+	return requests, nil
+}
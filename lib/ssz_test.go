@@ -0,0 +1,156 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/bellatrix"
+	"github.com/protolambda/zrnt/eth2/beacon/capella"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/deneb"
+	"github.com/protolambda/zrnt/eth2/beacon/electra"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/codec"
+)
+
+// sszFixture re-encodes a JSON block response as SSZ, using zrnt as an
+// independent encoder.
+func sszFixture(t *testing.T, file string) ([]byte, *clBlock) {
+	t.Helper()
+	data, err := os.ReadFile("./testdata/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Version string          `json:"version"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var obj interface {
+		Serialize(*common.Spec, *codec.EncodingWriter) error
+	}
+	switch resp.Version {
+	case "bellatrix":
+		obj = new(bellatrix.SignedBeaconBlock)
+	case "capella":
+		obj = new(capella.SignedBeaconBlock)
+	case "deneb":
+		obj = new(deneb.SignedBeaconBlock)
+	case "electra":
+		obj = new(electra.SignedBeaconBlock)
+	}
+	if err := json.Unmarshal(resp.Data, obj); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := obj.Serialize(configs.Mainnet, codec.NewEncodingWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	cl := &remoteCL{}
+	want, err := cl.decodeJSONBlock(http.StatusOK, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), want
+}
+
+func TestDecodeSSZBlock(t *testing.T) {
+	for _, file := range []string{"head.resp", "dencun.resp", "electra_deposits.resp", "electra_withdrawals.resp", "electra_consolidations.resp"} {
+		enc, want := sszFixture(t, file)
+		have, err := decodeSSZBlock(want.fork, enc)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if have.slot != want.slot || have.parentRoot != want.parentRoot {
+			t.Fatalf("%s: wrong block fields: have %d %x, want %d %x", file, have.slot, have.parentRoot, want.slot, want.parentRoot)
+		}
+		haveJSON, _ := json.Marshal(have.execData)
+		wantJSON, _ := json.Marshal(want.execData)
+		if !bytes.Equal(haveJSON, wantJSON) {
+			t.Fatalf("%s: payload mismatch\nhave %s\nwant %s", file, haveJSON, wantJSON)
+		}
+		if len(have.requests) != len(want.requests) {
+			t.Fatalf("%s: have %d requests, want %d", file, len(have.requests), len(want.requests))
+		}
+		if !reflect.DeepEqual(have.commitments, want.commitments) {
+			t.Fatalf("%s: blob commitments mismatch", file)
+		}
+		for i := range have.requests {
+			if !bytes.Equal(have.requests[i], want.requests[i]) {
+				t.Fatalf("%s: request %d mismatch", file, i)
+			}
+		}
+		if _, err := NewBlockUpdate(have); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if _, err := decodeSSZBlock(want.fork, enc[:len(enc)/2]); err == nil {
+			t.Fatalf("%s: expected error on truncated input", file)
+		}
+	}
+}
+
+func TestGetBlockSSZ(t *testing.T) {
+	enc, want := sszFixture(t, "dencun.resp")
+	jsonResp, err := os.ReadFile("./testdata/dencun.resp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var supportSSZ bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "application/octet-stream") {
+			if !supportSSZ {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Eth-Consensus-Version", "deneb")
+			w.Write(enc)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonResp)
+	}))
+	defer srv.Close()
+
+	for _, ssz := range []bool{true, false} {
+		supportSSZ = ssz
+		cl, _ := newRemoteCL(srv.URL, "test", nil)
+		block, err := cl.GetBlock("head")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.execData.BlockHash != want.execData.BlockHash {
+			t.Fatalf("ssz %v: wrong block hash", ssz)
+		}
+		if have, want := block.rawFormat, map[bool]string{true: "ssz", false: "json"}[ssz]; have != want {
+			t.Fatalf("ssz %v: have format %s, want %s", ssz, have, want)
+		}
+		if cl.noSSZ.Load() == ssz {
+			t.Fatalf("ssz %v: wrong fallback state", ssz)
+		}
+	}
+}
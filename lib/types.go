@@ -17,6 +17,8 @@
 package lib
 
 import (
+	"encoding/binary"
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/beacon/engine"
@@ -24,12 +26,15 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
 )
 
 type CLConfig struct {
 	Name    string
 	Address string
 	Headers map[string]string
+	// Priority orders the CL clients, lower values are preferred.
+	Priority int
 }
 
 type ELConfig struct {
@@ -37,11 +42,87 @@ type ELConfig struct {
 	Address   string
 	Headers   map[string]string
 	JwtSecret string
+	// Primary marks the EL whose responses are returned. The other ELs take
+	// over in configuration order if it becomes unhealthy. Defaults to the
+	// first configured EL.
+	Primary bool
+	// Builder marks the EL which builds payloads for the CL. Forkchoice
+	// updates with payload attributes are only sent to it. Defaults to the
+	// current primary.
+	Builder bool
+
+	// BreakerThreshold is the number of consecutive failed calls which open
+	// the circuit breaker of the EL. Defaults to 6.
+	BreakerThreshold int
+	// BreakerCooldown is the time in seconds the breaker stays open, before
+	// calls are let through again as probes. Defaults to 120.
+	BreakerCooldown int
+	// BreakerProbes is the number of successful probes which close the
+	// breaker again. Defaults to 1.
+	BreakerProbes int
 }
 
 type Config struct {
 	ElClients []ELConfig
-	ClClient  CLConfig
+	ClClients []CLConfig
+	ClClient  CLConfig // Deprecated: single CL client, use ClClients instead.
+
+	// BackfillDepth is the maximum number of missed ancestors delivered
+	// before a new head. Defaults to 32.
+	BackfillDepth int
+	// BadBlockDir is where CL responses are written if the block in them
+	// fails verification. Defaults to "badblocks".
+	BadBlockDir string
+	// DivergenceDir is where reports are written when the ELs disagree on a
+	// block. Defaults to "divergences".
+	DivergenceDir string
+	// BlobArchive is the directory where the blobs of delivered blocks are
+	// archived. Archiving is disabled if empty.
+	BlobArchive string
+	// Verify enables verified mode, if a network is set.
+	Verify VerifyConfig
+	// Passive enables passive mode, if a listen address is set.
+	Passive PassiveConfig
+	// Admin enables the admin HTTP API, if a listen address is set.
+	Admin AdminConfig
+	// Metrics enables the Prometheus metrics endpoint, if a listen address is
+	// set.
+	Metrics MetricsConfig
+}
+
+// AdminConfig configures the admin HTTP API.
+type AdminConfig struct {
+	// Listen is the address the admin API is served on, e.g. "127.0.0.1:8560".
+	// It is unauthenticated, so it should not be reachable by others.
+	Listen string
+}
+
+// MetricsConfig configures the Prometheus metrics endpoint.
+type MetricsConfig struct {
+	// Listen is the address the metrics are served on, at /metrics.
+	Listen string
+}
+
+// PassiveConfig configures passive mode, where Factor serves the engine API
+// to the CL instead of fetching from it.
+type PassiveConfig struct {
+	// Listen is the address the engine API is served on, e.g. "127.0.0.1:8551".
+	Listen string
+	// JwtSecret is the hex-encoded secret the CL authenticates with.
+	JwtSecret string
+}
+
+// VerifyConfig configures verified mode, where the beacon light client is used
+// to only relay execution payloads attested by the sync committee.
+type VerifyConfig struct {
+	// Network is the beacon chain: mainnet, sepolia, holesky or hoodi.
+	Network string
+	// Checkpoint is the trusted beacon block root the light client bootstraps
+	// from. Defaults to the checkpoint shipped with go-ethereum, if any.
+	Checkpoint string
+	// Threshold is the minimum number of sync committee signers required.
+	// Defaults to 342, two thirds of the committee.
+	Threshold int
 }
 
 type clWithDrawal struct {
@@ -92,19 +173,194 @@ type beaconBlockMarshaling struct {
 
 // cat head.resp | jq ".data .message .body .execution_payload"
 type bellatrixBlock struct {
-	Data struct {
+	Version string `json:"version"`
+	Data    struct {
 		Message struct {
-			ParentRoot common.Hash `json:"parent_root"`
+			Slot       math.HexOrDecimal64 `json:"slot"`
+			ParentRoot common.Hash         `json:"parent_root"`
 			Body       struct {
-				ExecutionPayload beaconBlock `json:"execution_payload"'`
+				ExecutionPayload   beaconBlock          `json:"execution_payload"`
+				BlobKzgCommitments []kzg4844.Commitment `json:"blob_kzg_commitments"`
+				ExecutionRequests  *clExecutionRequests `json:"execution_requests"`
 			} `json:"body"`
 		} `json:"message"`
 	} `json:"data"`
 }
 
-func (b beaconBlock) toExecutableDataV1() engine.ExecutableData {
-	var withdrawals []*types.Withdrawal
+// Execution request types, as per EIP-7685.
+const (
+	depositRequestType       = 0x00
+	withdrawalRequestType    = 0x01
+	consolidationRequestType = 0x02
+)
+
+type clDepositRequest struct {
+	Pubkey                hexutil.Bytes       `json:"pubkey"`
+	WithdrawalCredentials common.Hash         `json:"withdrawal_credentials"`
+	Amount                math.HexOrDecimal64 `json:"amount"`
+	Signature             hexutil.Bytes       `json:"signature"`
+	Index                 math.HexOrDecimal64 `json:"index"`
+}
 
+type clWithdrawalRequest struct {
+	SourceAddress   common.Address      `json:"source_address"`
+	ValidatorPubkey hexutil.Bytes       `json:"validator_pubkey"`
+	Amount          math.HexOrDecimal64 `json:"amount"`
+}
+
+type clConsolidationRequest struct {
+	SourceAddress common.Address `json:"source_address"`
+	SourcePubkey  hexutil.Bytes  `json:"source_pubkey"`
+	TargetPubkey  hexutil.Bytes  `json:"target_pubkey"`
+}
+
+// clExecutionRequests are the execution requests of an electra beacon block.
+type clExecutionRequests struct {
+	Deposits       []clDepositRequest       `json:"deposits"`
+	Withdrawals    []clWithdrawalRequest    `json:"withdrawals"`
+	Consolidations []clConsolidationRequest `json:"consolidations"`
+}
+
+// encode converts the requests into the engine API format: for each request
+// type, the type byte followed by the SSZ encoding of the list. Types without
+// requests are left out.
+func (r *clExecutionRequests) encode() ([][]byte, error) {
+	var (
+		requests = make([][]byte, 0, 3)
+		err      error
+	)
+	// fixed appends b to the buffer, checking that it has the SSZ-mandated size.
+	fixed := func(buf []byte, b []byte, size int, field string) []byte {
+		if len(b) != size && err == nil {
+			err = fmt.Errorf("invalid %s length %d, want %d", field, len(b), size)
+		}
+		return append(buf, b...)
+	}
+	if len(r.Deposits) > 0 {
+		buf := []byte{depositRequestType}
+		for _, d := range r.Deposits {
+			buf = fixed(buf, d.Pubkey, 48, "deposit pubkey")
+			buf = append(buf, d.WithdrawalCredentials[:]...)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(d.Amount))
+			buf = fixed(buf, d.Signature, 96, "deposit signature")
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(d.Index))
+		}
+		requests = append(requests, buf)
+	}
+	if len(r.Withdrawals) > 0 {
+		buf := []byte{withdrawalRequestType}
+		for _, w := range r.Withdrawals {
+			buf = append(buf, w.SourceAddress[:]...)
+			buf = fixed(buf, w.ValidatorPubkey, 48, "withdrawal pubkey")
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(w.Amount))
+		}
+		requests = append(requests, buf)
+	}
+	if len(r.Consolidations) > 0 {
+		buf := []byte{consolidationRequestType}
+		for _, c := range r.Consolidations {
+			buf = append(buf, c.SourceAddress[:]...)
+			buf = fixed(buf, c.SourcePubkey, 48, "consolidation source pubkey")
+			buf = fixed(buf, c.TargetPubkey, 48, "consolidation target pubkey")
+		}
+		requests = append(requests, buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// fork is a consensus layer fork, as named in the 'version' field of beacon
+// API responses.
+type fork int
+
+const (
+	forkUnknown fork = iota
+	forkBellatrix
+	forkCapella
+	forkDeneb
+	forkElectra
+)
+
+var forkNames = map[fork]string{
+	forkBellatrix: "bellatrix",
+	forkCapella:   "capella",
+	forkDeneb:     "deneb",
+	forkElectra:   "electra",
+}
+
+// payloadV4 is the version of engine_newPayloadV4 and engine_getPayloadV4,
+// which the engine package does not define since its payload format is the
+// same as V3.
+var payloadV4 engine.PayloadVersion = 0x4
+
+// parseFork returns the fork with the given name, or forkUnknown.
+func parseFork(name string) fork {
+	for f, n := range forkNames {
+		if n == name {
+			return f
+		}
+	}
+	return forkUnknown
+}
+
+func (f fork) String() string {
+	if name, ok := forkNames[f]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// payloadVersion returns the engine API version used to send payloads of the
+// fork to the EL, via engine_newPayloadVx.
+func (f fork) payloadVersion() engine.PayloadVersion {
+	switch f {
+	case forkBellatrix:
+		return engine.PayloadV1
+	case forkCapella:
+		return engine.PayloadV2
+	case forkDeneb:
+		return engine.PayloadV3
+	default:
+		return payloadV4
+	}
+}
+
+// forkchoiceVersion returns the engine API version used to update the
+// forkchoice to a head of the fork, via engine_forkchoiceUpdatedVx.
+func (f fork) forkchoiceVersion() engine.PayloadVersion {
+	switch f {
+	case forkBellatrix:
+		return engine.PayloadV1
+	case forkCapella:
+		return engine.PayloadV2
+	default:
+		return engine.PayloadV3
+	}
+}
+
+// clBlock is a beacon block as fetched from the CL, reduced to the parts
+// Factor relays to the ELs.
+type clBlock struct {
+	fork        fork
+	slot        uint64
+	parentRoot  common.Hash // beacon root of the parent block
+	execData    engine.ExecutableData
+	commitments []kzg4844.Commitment // blob KZG commitments, nil before deneb
+	requests    [][]byte             // execution requests, nil before electra
+	raw         []byte               // raw CL response, for debugging
+	rawFormat   string               // format of the raw response, "json" or "ssz"
+}
+
+// toExecutableData converts the payload into the engine API format. The fork
+// decides which of the optional fields are set, since their presence changes
+// the block hash.
+func (b beaconBlock) toExecutableData(f fork) engine.ExecutableData {
+	var withdrawals []*types.Withdrawal
+	if f >= forkCapella {
+		withdrawals = make([]*types.Withdrawal, 0, len(b.Withdrawals))
+	}
 	for _, w := range b.Withdrawals {
 		ww := &types.Withdrawal{
 			Index:     uint64(w.Index),
@@ -131,9 +387,10 @@ func (b beaconBlock) toExecutableDataV1() engine.ExecutableData {
 		BaseFeePerGas: b.BaseFeePerGas,
 		BlockHash:     b.BlockHash,
 		Transactions:  b.Transactions,
-
-		ExcessBlobGas: &b.ExcessBlobGas,
-		BlobGasUsed:   &b.BlobGasUsed,
+	}
+	if f >= forkDeneb {
+		resp.ExcessBlobGas = &b.ExcessBlobGas
+		resp.BlobGasUsed = &b.BlobGasUsed
 	}
 	return resp
 }
@@ -0,0 +1,193 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/beacon/light"
+	"github.com/ethereum/go-ethereum/beacon/light/api"
+	"github.com/ethereum/go-ethereum/beacon/light/request"
+	lsync "github.com/ethereum/go-ethereum/beacon/light/sync"
+	"github.com/ethereum/go-ethereum/beacon/params"
+	btypes "github.com/ethereum/go-ethereum/beacon/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// defaultThreshold is the default number of sync committee signers required,
+// two thirds of the committee.
+const defaultThreshold = 342
+
+// verifiedHeader is a beacon block header attested by the sync committee,
+// along with the hash of its execution payload.
+type verifiedHeader struct {
+	slot       uint64
+	beaconRoot common.Hash
+	blockHash  common.Hash
+}
+
+// lightVerifier follows the beacon chain through the light client API of the
+// CL sources, and tracks the latest head and finalized headers which are
+// signed by the sync committee.
+type lightVerifier struct {
+	scheduler *request.Scheduler
+	tracker   *light.HeadTracker
+	servers   []CLConfig
+	updateCh  chan struct{} // signalled when a new head or finalized header is verified
+
+	mu        sync.Mutex
+	head      verifiedHeader
+	finalized verifiedHeader
+}
+
+// lightChainConfig returns the beacon chain configuration of the given
+// network.
+func lightChainConfig(network string) (*params.ChainConfig, error) {
+	var config *params.ChainConfig
+	switch strings.ToLower(network) {
+	case "mainnet":
+		config = params.MainnetLightConfig
+	case "sepolia":
+		config = params.SepoliaLightConfig
+	case "holesky":
+		config = params.HoleskyLightConfig
+	case "hoodi":
+		config = params.HoodiLightConfig
+	default:
+		return nil, fmt.Errorf("unknown verify network %q", network)
+	}
+	cpy := *config
+	return &cpy, nil
+}
+
+// newLightVerifier creates a verifier using the given CL sources as light
+// client API servers.
+func newLightVerifier(config VerifyConfig, servers []CLConfig) (*lightVerifier, error) {
+	chainConfig, err := lightChainConfig(config.Network)
+	if err != nil {
+		return nil, err
+	}
+	if config.Checkpoint != "" {
+		checkpoint, err := hexToHash(config.Checkpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verify checkpoint: %v", err)
+		}
+		chainConfig.Checkpoint = checkpoint
+	}
+	if chainConfig.Checkpoint == (common.Hash{}) {
+		return nil, fmt.Errorf("no checkpoint known for %s, configure one", config.Network)
+	}
+	threshold := config.Threshold
+	if threshold <= 0 {
+		threshold = defaultThreshold
+	}
+	var (
+		committeeChain = light.NewCommitteeChain(memorydb.New(), chainConfig, threshold, true)
+		tracker        = light.NewHeadTracker(committeeChain, threshold, func(common.Hash) {})
+		scheduler      = request.NewScheduler()
+	)
+	v := &lightVerifier{
+		scheduler: scheduler,
+		tracker:   tracker,
+		servers:   servers,
+		updateCh:  make(chan struct{}, 1),
+	}
+	scheduler.RegisterTarget(tracker)
+	scheduler.RegisterTarget(committeeChain)
+	scheduler.RegisterModule(lsync.NewCheckpointInit(committeeChain, chainConfig.Checkpoint), "checkpointInit")
+	scheduler.RegisterModule(lsync.NewForwardUpdateSync(committeeChain), "forwardSync")
+	scheduler.RegisterModule(lsync.NewHeadSync(tracker, committeeChain), "headSync")
+	scheduler.RegisterModule(v, "factorVerifier")
+	log.Info("Verified mode enabled", "network", config.Network, "checkpoint", chainConfig.Checkpoint, "threshold", threshold)
+	return v, nil
+}
+
+func hexToHash(s string) (common.Hash, error) {
+	b, err := common.ParseHexOrString(s)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(b) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("expected %d bytes, got %d", common.HashLength, len(b))
+	}
+	return common.BytesToHash(b), nil
+}
+
+func (v *lightVerifier) Start() {
+	v.scheduler.Start()
+	for _, server := range v.servers {
+		beaconApi := api.NewBeaconLightApi(server.Address, server.Headers)
+		v.scheduler.RegisterServer(request.NewServer(api.NewApiServer(beaconApi), &mclock.System{}))
+	}
+}
+
+func (v *lightVerifier) Stop() {
+	v.scheduler.Stop()
+}
+
+// Process implements request.Module. It is called by the scheduler whenever
+// the head tracker may have validated new headers.
+func (v *lightVerifier) Process(request.Requester, []request.Event) {
+	var head, finalized verifiedHeader
+	if update, ok := v.tracker.ValidatedOptimistic(); ok {
+		head = newVerifiedHeader(update.Attested)
+	}
+	if update, ok := v.tracker.ValidatedFinality(); ok {
+		finalized = newVerifiedHeader(update.Finalized)
+	}
+	v.mu.Lock()
+	changed := head != v.head || finalized != v.finalized
+	v.head, v.finalized = head, finalized
+	v.mu.Unlock()
+
+	if changed {
+		log.Debug("Verified beacon headers", "head", head.slot, "headRoot", head.beaconRoot,
+			"finalized", finalized.slot, "finalizedRoot", finalized.beaconRoot)
+		select {
+		case v.updateCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func newVerifiedHeader(h btypes.HeaderWithExecProof) verifiedHeader {
+	vh := verifiedHeader{slot: h.Slot, beaconRoot: h.Hash()}
+	if h.PayloadHeader != nil {
+		vh.blockHash = h.PayloadHeader.BlockHash()
+	}
+	return vh
+}
+
+// Head returns the latest verified head header, or false if there is none yet.
+func (v *lightVerifier) Head() (verifiedHeader, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.head, v.head.blockHash != (common.Hash{})
+}
+
+// Finalized returns the latest verified finalized header, or false if there is
+// none yet.
+func (v *lightVerifier) Finalized() (verifiedHeader, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.finalized, v.finalized.blockHash != (common.Hash{})
+}
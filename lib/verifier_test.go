@@ -0,0 +1,75 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNewLightVerifier(t *testing.T) {
+	for _, tt := range []struct {
+		config VerifyConfig
+		ok     bool
+	}{
+		{VerifyConfig{Network: "mainnet"}, true},
+		{VerifyConfig{Network: "Sepolia", Threshold: 400}, true},
+		{VerifyConfig{Network: "hoodi"}, false}, // no built-in checkpoint
+		{VerifyConfig{Network: "hoodi", Checkpoint: "0x" + common.Bytes2Hex(make([]byte, 31)) + "01"}, true},
+		{VerifyConfig{Network: "hoodi", Checkpoint: "0x1234"}, false},
+		{VerifyConfig{Network: "goerli"}, false},
+	} {
+		_, err := newLightVerifier(tt.config, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: have err %v, want ok %v", tt.config, err, tt.ok)
+		}
+	}
+}
+
+func TestFetchVerified(t *testing.T) {
+	resp, err := os.ReadFile("./testdata/dencun.resp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	f, err := NewFetcher(Config{ClClients: []CLConfig{{Name: "test", Address: srv.URL}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := f.source().GetBlock("head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := verifiedHeader{slot: block.slot, blockHash: block.execData.BlockHash}
+	if _, err := f.fetchVerified(header); err != nil {
+		t.Fatalf("attested block rejected: %v", err)
+	}
+	header.blockHash = common.Hash{1}
+	if _, err := f.fetchVerified(header); !errors.Is(err, errUnverified) {
+		t.Fatalf("have err %v, want %v", err, errUnverified)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// maxQueuedPayloads is the maximum number of payloads queued for an EL. If a
+// client falls further behind, the oldest payloads are dropped.
+const maxQueuedPayloads = 32
+
+var (
+	errSuperseded = errors.New("superseded by newer forkchoice update")
+	errDropped    = errors.New("dropped from full queue")
+	errStopped    = errors.New("relay stopped")
+	errPaused     = errors.New("EL paused")
+)
+
+// elTask is an engine API call queued for an EL.
+type elTask struct {
+	method     string
+	forkchoice bool      // forkchoice updates supersede each other
+	block      *blockRef // block the call is about, if known
+	call       func(el ElApi) (engine.PayloadStatusV1, error)
+	record     func(elAnswer) // records the answer, may be nil
+	done       chan struct{}  // closed when the call is done, if someone waits for it
+}
+
+func (t *elTask) finish(answer elAnswer) {
+	if t.record != nil {
+		t.record(answer)
+	}
+	if t.done != nil {
+		close(t.done)
+	}
+}
+
+// elWorker delivers the calls for one EL in order, so that a slow client does
+// not hold up the others. Queued forkchoice updates are coalesced, and the
+// oldest payloads are dropped if the queue is full, so a lagging client skips
+// ahead to the newest head.
+type elWorker struct {
+	el         ElApi
+	metrics    *elMetrics
+	wake       chan struct{}
+	quit       chan struct{}
+	wg         sync.WaitGroup
+	dropped    atomic.Uint64               // number of calls dropped from the queue
+	catchingUp atomic.Bool                 // whether a catch-up is queued or running
+	catchUpTo  atomic.Pointer[payloadCall] // newest payload the queued catch-up leads to
+
+	mu          sync.Mutex
+	queue       []*elTask
+	closed      bool
+	stats       elStats
+	paused      bool
+	pausedUntil time.Time // end of the pause, zero if paused until resumed
+}
+
+// elStats are the delivery statistics of an EL, for status reporting.
+type elStats struct {
+	LastBlock  *blockRef `json:"lastBlock,omitempty"`  // last block delivered
+	LastStatus string    `json:"lastStatus,omitempty"` // status of the last answered call
+	LastError  string    `json:"lastError,omitempty"`  // last failure
+	LatencyMs  float64   `json:"latencyMs"`            // duration of the last call
+	Errors     uint64    `json:"errors"`               // number of failed calls
+}
+
+func newELWorker(el ElApi) *elWorker {
+	w := &elWorker{
+		el:      el,
+		metrics: newELMetrics(el.Name()),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.loop()
+	return w
+}
+
+// push queues a task.
+func (w *elWorker) push(task *elTask) {
+	var dropped []*elTask
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		task.finish(newAnswer(w.el, engine.PayloadStatusV1{}, errStopped))
+		return
+	}
+	if task.forkchoice {
+		kept := w.queue[:0]
+		for _, t := range w.queue {
+			if t.forkchoice && t.done == nil {
+				dropped = append(dropped, t)
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		w.queue = kept
+	} else if w.payloads() >= maxQueuedPayloads {
+		for i, t := range w.queue {
+			if !t.forkchoice && t.done == nil {
+				dropped = append(dropped, t)
+				w.queue = append(w.queue[:i], w.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	w.queue = append(w.queue, task)
+	w.metrics.queue.Update(int64(len(w.queue)))
+	w.mu.Unlock()
+
+	for _, t := range dropped {
+		err := errSuperseded
+		if !t.forkchoice {
+			err = errDropped
+			log.Warn("EL falling behind, dropping payload", "el", elIdentity(w.el), "method", t.method)
+		}
+		w.dropped.Add(1)
+		w.metrics.dropped.Inc(1)
+		t.finish(newAnswer(w.el, engine.PayloadStatusV1{}, err))
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// payloads returns the number of queued payloads. The lock must be held.
+func (w *elWorker) payloads() int {
+	var n int
+	for _, t := range w.queue {
+		if !t.forkchoice {
+			n++
+		}
+	}
+	return n
+}
+
+// Pending returns the number of queued calls.
+func (w *elWorker) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queue)
+}
+
+func (w *elWorker) loop() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			select {
+			case <-w.wake:
+				continue
+			case <-w.quit:
+				return
+			}
+		}
+		task := w.queue[0]
+		w.queue = w.queue[1:]
+		w.metrics.queue.Update(int64(len(w.queue)))
+		w.mu.Unlock()
+
+		if w.isPaused() {
+			task.finish(newAnswer(w.el, engine.PayloadStatusV1{}, errPaused))
+			continue
+		}
+		start := time.Now()
+		status, err := task.call(w.el)
+		w.record(task, status, err, time.Since(start))
+		if err != nil {
+			log.Info("Remote call error", "method", task.method, "el", elIdentity(w.el), "err", err)
+		}
+		task.finish(newAnswer(w.el, status, err))
+	}
+}
+
+// record updates the statistics and metrics with the outcome of a call.
+func (w *elWorker) record(task *elTask, status engine.PayloadStatusV1, err error, elapsed time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.metrics.record(task, status, err, elapsed)
+	w.metrics.setClient(clientVersion(w.el))
+
+	w.stats.LatencyMs = float64(elapsed.Microseconds()) / 1000
+	if err != nil {
+		w.stats.Errors++
+		w.stats.LastError = err.Error()
+		return
+	}
+	w.stats.LastStatus = status.Status
+	if !task.forkchoice && task.block != nil {
+		w.stats.LastBlock = task.block
+	}
+}
+
+// Stats returns the delivery statistics of the EL.
+func (w *elWorker) Stats() elStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+// pause stops the delivery to the EL for the given duration, or until resumed
+// if zero. Calls queued meanwhile fail.
+func (w *elWorker) pause(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused, w.pausedUntil = true, time.Time{}
+	if d > 0 {
+		w.pausedUntil = time.Now().Add(d)
+	}
+}
+
+// resume ends a pause.
+func (w *elWorker) resume() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused, w.pausedUntil = false, time.Time{}
+}
+
+// isPaused reports whether the delivery to the EL is paused.
+func (w *elWorker) isPaused() bool {
+	paused, _ := w.pauseState()
+	return paused
+}
+
+// pauseState returns whether the delivery to the EL is paused, and until when.
+// The time is zero if paused until resumed.
+func (w *elWorker) pauseState() (bool, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused && !w.pausedUntil.IsZero() && time.Now().After(w.pausedUntil) {
+		w.paused, w.pausedUntil = false, time.Time{}
+	}
+	return w.paused, w.pausedUntil
+}
+
+// close stops the worker, and fails the calls still queued.
+func (w *elWorker) close() {
+	close(w.quit)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	queue := w.queue
+	w.queue, w.closed = nil, true
+	w.mu.Unlock()
+	for _, t := range queue {
+		t.finish(newAnswer(w.el, engine.PayloadStatusV1{}, errStopped))
+	}
+}
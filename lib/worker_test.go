@@ -0,0 +1,79 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/beacon/engine"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Tests that a stuck EL does not hold up the primary, and that it skips ahead
+// to the newest head once it recovers.
+func TestRelaySlowEL(t *testing.T) {
+	var (
+		fast  = newMockEL("fast")
+		slow  = newMockEL("slow")
+		relay = newRelay([]ElApi{fast, slow})
+	)
+	defer relay.Close()
+	slow.gate = make(chan struct{})
+
+	n := maxQueuedPayloads + 5
+	for i := 1; i <= n; i++ {
+		payload := engine.ExecutableData{Number: uint64(i), BlockHash: common.Hash{byte(i)}}
+		done := make(chan struct{})
+		go func() {
+			relay.NewPayload(engine.PayloadV3, payload, nil, nil, nil)
+			relay.ForkchoiceUpdated(engine.PayloadV3, engine.ForkchoiceStateV1{HeadBlockHash: payload.BlockHash}, nil)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("relay blocked by slow EL at block %d", i)
+		}
+		if i == 1 {
+			// Wait for the first payload to be in flight.
+			for relay.workers[1].Pending() > 1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	fast.waitCalls(t, 2*n)
+
+	// The first payload is in flight, the rest is queued. Once the slow EL
+	// recovers, it gets the newest payloads and only the last forkchoice.
+	close(slow.gate)
+	slow.waitCalls(t, 1+maxQueuedPayloads+1)
+	var want []string
+	want = append(want, "NP 1")
+	for i := n - maxQueuedPayloads + 1; i <= n; i++ {
+		want = append(want, fmt.Sprintf("NP %d", i))
+	}
+	want = append(want, "FCU "+common.Hash{byte(n)}.TerminalString())
+	if !reflect.DeepEqual(slow.methods, want) {
+		t.Fatalf("wrong calls:\nhave %v\nwant %v", slow.methods, want)
+	}
+	if have := relay.workers[1].dropped.Load(); have != uint64(2*n-len(want)) {
+		t.Fatalf("have %d dropped, want %d", have, 2*n-len(want))
+	}
+}